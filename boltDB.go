@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// record store persisted in a bolt file
+type boltStore struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	bucket *bolt.Bucket
+}
+
+var resourceBucket = []byte("resources")
+
+// creates a GoBusDB which stores all resources in the bolt file at path
+// the file is created if it does not exist
+func NewBoltDB(path string) (GoBusDB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(resourceBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	recordDB, err := newRecordDB(&boltStore{db})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return recordDB, nil
+}
+
+func (s *boltStore) update(f func(tx recordTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return f(&boltTx{tx.Bucket(resourceBucket)})
+	})
+}
+
+func (s *boltStore) view(f func(tx recordTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return f(&boltTx{tx.Bucket(resourceBucket)})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func (tx *boltTx) get(key string) (*resourceRecord, error) {
+	data := tx.bucket.Get([]byte(key))
+	if data == nil {
+		return nil, nil
+	}
+	rec := newRecord("", false)
+	err := json.Unmarshal(data, rec)
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (tx *boltTx) put(key string, rec *resourceRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return tx.bucket.Put([]byte(key), data)
+}
+
+func (tx *boltTx) delete(key string) error {
+	return tx.bucket.Delete([]byte(key))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// creates a bolt db in a temporary directory
+// returns a function to remove the directory
+func newTestBoltDB(t *testing.T) (GoBusDB, string, func()) {
+	dir, err := ioutil.TempDir("", "gobus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.db")
+	db, err := NewBoltDB(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, path, func() {
+		db.(*RecordDB).Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T) (GoBusDB, func()) {
+		db, _, teardown := newTestBoltDB(t)
+		return db, teardown
+	})
+}
+
+func TestBoltPersistence(t *testing.T) {
+	db, path, teardown := newTestBoltDB(t)
+	defer teardown()
+
+	res, _ := db.CreateResource([]string{"coll"}, false, "", nil, time.Time{})
+	res.AddToCollection("text/plain", []byte("bla"), time.Time{})
+	res.AddHook([]byte(`{"name": "hook_name", "url": "http://www.test.ch/my/resource"}`))
+	res.AddForward([]byte(`{"url": "http://blup.com/a/hook"}`))
+	db.(*RecordDB).Close()
+
+	db, err := NewBoltDB(path)
+	if err != nil {
+		t.Fatal("reopen failed", err)
+	}
+	child, err := db.GetResource([]string{"coll", "0"})
+	if err != nil {
+		t.Fatal("child lost on reopen")
+	}
+	ct, value, _ := child.GetValue()
+	if ct != "text/plain" || !bytes.Equal(value, []byte("bla")) {
+		t.Error("value lost on reopen")
+	}
+	res, _ = db.GetResource([]string{"coll"})
+	if name, _ := res.AddToCollection("text/plain", []byte("blup"), time.Time{}); name != "1" {
+		t.Error("nextID lost on reopen")
+	}
+	if id, _ := res.AddHook([]byte(`{"name": "other", "url": "http://www.test.ch"}`)); id != "1" {
+		t.Error("nextHookID lost on reopen")
+	}
+	if hook, err := res.GetHook("0"); err != nil || hook.Name != "hook_name" {
+		t.Error("hook lost on reopen")
+	}
+	if f, _ := res.GetForward(); f.URL != "http://blup.com/a/hook" {
+		t.Error("forward lost on reopen")
+	}
+	db.(*RecordDB).Close()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// formats of the events posted to hooks
+const (
+	formatGobus             = "gobus"              // HookEvent, the default
+	formatCloudEvents       = "cloudevents"        // CloudEvents 1.0 in structured mode
+	formatCloudEventsBinary = "cloudevents-binary" // CloudEvents 1.0 in binary mode
+)
+
+var hookFormats = []string{"", formatGobus, formatCloudEvents, formatCloudEventsBinary}
+
+// the source of CloudEvents, set to the base URL of gobus
+var eventSource = "/"
+
+// an event in the structured mode of CloudEvents 1.0
+// see https://github.com/cloudevents/spec/blob/v1.0/json-format.md
+type CloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            HookEvent `json:"data"`
+}
+
+// returns the CloudEvents type of an event, e.g. gobus.put or gobus.hooks.delete for commands
+func cloudEventType(event HookEvent) string {
+	eventType := "gobus."
+	if event.Command != "" {
+		eventType += strings.TrimPrefix(event.Command, "_") + "."
+	}
+	return eventType + strings.ToLower(event.Method)
+}
+
+// returns the body and the headers of an event in the format of a hook
+// id and t identify the event and the time it happened
+func formatEvent(format string, event HookEvent, id string, t time.Time) ([]byte, map[string]string, error) {
+	switch format {
+	case formatCloudEvents:
+		data, err := json.Marshal(CloudEvent{
+			SpecVersion:     "1.0",
+			ID:              id,
+			Source:          eventSource,
+			Type:            cloudEventType(event),
+			Subject:         event.ModifiedResource,
+			Time:            t,
+			DataContentType: "application/json",
+			Data:            event,
+		})
+		return data, map[string]string{"Content-Type": "application/cloudevents+json"}, err
+	case formatCloudEventsBinary:
+		data, err := json.Marshal(event)
+		headers := map[string]string{
+			"Content-Type":   "application/json",
+			"Ce-Specversion": "1.0",
+			"Ce-Id":          id,
+			"Ce-Source":      eventSource,
+			"Ce-Type":        cloudEventType(event),
+			"Ce-Subject":     event.ModifiedResource,
+			"Ce-Time":        t.UTC().Format(time.RFC3339Nano),
+		}
+		return data, headers, err
+	default:
+		data, err := json.Marshal(event)
+		return data, map[string]string{}, err
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCloudEventType(t *testing.T) {
+	tests := map[string]HookEvent{
+		"gobus.put":         {Method: "PUT"},
+		"gobus.create":      {Method: "CREATE"},
+		"gobus.hooks.post":  {Method: "POST", Command: "_hooks"},
+		"gobus.forward.put": {Method: "PUT", Command: "_forward"},
+	}
+	for expected, event := range tests {
+		if eventType := cloudEventType(event); eventType != expected {
+			t.Error("Wrong event type", eventType, expected)
+		}
+	}
+}
+
+func TestFormatEvent(t *testing.T) {
+	event := HookEvent{Name: "ce", Method: "PUT", Item: true, ModifiedResource: "/asdf/qwer/1"}
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	data, headers, err := formatEvent("", event, "abc", now)
+	var plain HookEvent
+	if err != nil || len(headers) != 0 || json.Unmarshal(data, &plain) != nil || plain != event {
+		t.Error("Default format not working", string(data), headers)
+	}
+
+	data, headers, err = formatEvent(formatCloudEvents, event, "abc", now)
+	var structured CloudEvent
+	if err != nil || json.Unmarshal(data, &structured) != nil {
+		t.Fatal("Structured format not working", string(data), err)
+	}
+	if headers["Content-Type"] != "application/cloudevents+json" || structured.SpecVersion != "1.0" ||
+		structured.ID != "abc" || structured.Source != eventSource || structured.Type != "gobus.put" ||
+		structured.Subject != "/asdf/qwer/1" || !structured.Time.Equal(now) || structured.Data != event {
+		t.Error("Structured format: content not working", string(data), headers)
+	}
+
+	data, headers, err = formatEvent(formatCloudEventsBinary, event, "abc", now)
+	plain = HookEvent{}
+	if err != nil || json.Unmarshal(data, &plain) != nil || plain != event {
+		t.Fatal("Binary format: body not working", string(data), err)
+	}
+	if headers["Ce-Specversion"] != "1.0" || headers["Ce-Id"] != "abc" || headers["Ce-Source"] != eventSource ||
+		headers["Ce-Type"] != "gobus.put" || headers["Ce-Subject"] != "/asdf/qwer/1" ||
+		headers["Ce-Time"] != "2020-01-02T03:04:05Z" || headers["Content-Type"] != "application/json" {
+		t.Error("Binary format: headers not working", headers)
+	}
+}
+
+func TestParseHookFormat(t *testing.T) {
+	for _, format := range []string{"", "gobus", "cloudevents", "cloudevents-binary"} {
+		if _, err := parseHook([]byte(`{"name": "f", "url": "http://localhost", "format": "` + format + `"}`)); err != nil {
+			t.Error("Valid format rejected", format, err)
+		}
+	}
+	if _, err := parseHook([]byte(`{"name": "f", "url": "http://localhost", "format": "xml"}`)); err == nil {
+		t.Error("Invalid format accepted")
+	}
+}
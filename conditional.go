@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// returns the entity tag of a resource version
+func etag(version int64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// checks if a list of entity tags (If-Match, If-None-Match) contains the version
+// "*" matches any version, weak tags only match if weak comparison is allowed (RFC 7232, 2.3.2)
+func etagMatches(header string, version int64, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// checks If-None-Match of a GET request
+// sends a "Not Modified" (304) and returns true if the client has the current version
+func notModified(hd *HandlerData, version int64) bool {
+	header := hd.R.Header.Get("If-None-Match")
+	if header == "" || !etagMatches(header, version, true) {
+		return false
+	}
+	hd.W.Header().Set("ETag", etag(version))
+	hd.W.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// checks If-Match and If-None-Match of a request modifying an existing resource
+// returns the version the modification has to be conditional on
+// sends a "Precondition Failed" (412) and returns false if a precondition fails
+func checkPreconditions(hd *HandlerData, res Resource) (int64, bool) {
+	ifMatch := hd.R.Header.Get("If-Match")
+	ifNoneMatch := hd.R.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return anyVersion, true
+	}
+	version, err := res.Version()
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get version.")
+		return 0, false
+	}
+	if ifMatch != "" && !etagMatches(ifMatch, version, false) {
+		respond(hd, http.StatusPreconditionFailed, "Resource has been modified.")
+		return 0, false
+	}
+	if ifNoneMatch != "" && etagMatches(ifNoneMatch, version, true) {
+		respond(hd, http.StatusPreconditionFailed, "Resource matches If-None-Match.")
+		return 0, false
+	}
+	return version, true
+}
+
+// checks the preconditions of a request for an inexisting resource
+// If-Match can never be fulfilled, sends a "Precondition Failed" (412) and returns false
+func checkInexistingPreconditions(hd *HandlerData) bool {
+	if hd.R.Header.Get("If-Match") != "" {
+		respond(hd, http.StatusPreconditionFailed, "Resource does not exist.")
+		return false
+	}
+	return true
+}
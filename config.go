@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reads the public URL of gobus from BASE_URL
+// the path of the URL is the prefix gobus is mounted at
+// defaults to localhost on the given port
+func baseURLFromEnv(port string) (*url.URL, error) {
+	value := os.Getenv("BASE_URL")
+	if value == "" {
+		value = "http://localhost:" + port + "/"
+	}
+	baseURL, err := url.Parse(value)
+	if err != nil || baseURL.Scheme == "" || baseURL.Host == "" {
+		return nil, errors.New(fmt.Sprintf("Invalid value for BASE_URL: %s", value))
+	}
+	if !strings.HasSuffix(baseURL.Path, "/") {
+		baseURL.Path += "/"
+	}
+	return baseURL, nil
+}
+
+// reads the database configuration from the environment
+func dbConfigFromEnv() (DBConfig, error) {
+	redisCfg, err := redisConfigFromEnv()
+	if err != nil {
+		return DBConfig{}, err
+	}
+	return DBConfig{
+		Backend: os.Getenv("BACKEND"),
+		Path:    os.Getenv("DB_PATH"),
+		Redis:   redisCfg,
+	}, nil
+}
+
+// reads the redis connection configuration from the REDIS_* environment variables
+func redisConfigFromEnv() (RedisConfig, error) {
+	cfg := RedisConfig{
+		Addr:     os.Getenv("REDIS_ADDR"),
+		Password: os.Getenv("REDIS_PASSWORD"),
+		Prefix:   os.Getenv("REDIS_PREFIX"),
+	}
+	var err error
+	if cfg.DB, err = envInt("REDIS_DB"); err != nil {
+		return cfg, err
+	}
+	poolSize, err := envInt("REDIS_POOL_SIZE")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.PoolSize = int(poolSize)
+	durations := []struct {
+		Name  string
+		Value *time.Duration
+	}{
+		{"REDIS_POOL_TIMEOUT", &cfg.PoolTimeout},
+		{"REDIS_IDLE_TIMEOUT", &cfg.IdleTimeout},
+		{"REDIS_DIAL_TIMEOUT", &cfg.DialTimeout},
+		{"REDIS_READ_TIMEOUT", &cfg.ReadTimeout},
+		{"REDIS_WRITE_TIMEOUT", &cfg.WriteTimeout},
+	}
+	for _, d := range durations {
+		if *d.Value, err = envDuration(d.Name); err != nil {
+			return cfg, err
+		}
+	}
+	cfg.TLS, err = redisTLSFromEnv()
+	return cfg, err
+}
+
+// returns the TLS configuration for redis, nil if TLS is not enabled
+// REDIS_TLS enables TLS, REDIS_TLS_CA points to a PEM file with the CA certificates
+// REDIS_TLS_SKIP_VERIFY disables the verification of the server certificate
+func redisTLSFromEnv() (*tls.Config, error) {
+	enabled, err := envBool("REDIS_TLS")
+	if err != nil || !enabled {
+		return nil, err
+	}
+	skipVerify, err := envBool("REDIS_TLS_SKIP_VERIFY")
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{InsecureSkipVerify: skipVerify}
+	caFile := os.Getenv("REDIS_TLS_CA")
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("No certificates found in %s", caFile))
+		}
+	}
+	return cfg, nil
+}
+
+// returns the environment variable as integer, 0 if not set
+func envInt(name string) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid value for %s: %s", name, value))
+	}
+	return i, nil
+}
+
+// returns the environment variable as duration (e.g. 5s), 0 if not set
+func envDuration(name string) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid value for %s: %s", name, value))
+	}
+	return d, nil
+}
+
+// returns the environment variable as bool, false if not set
+func envBool(name string) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("Invalid value for %s: %s", name, value))
+	}
+	return b, nil
+}
+
+// reads the delivery configuration from the environment
+func deliveryConfigFromEnv() (DeliveryConfig, error) {
+	cfg := defaultDeliveryConfig()
+	if os.Getenv("HOOK_RETRIES") != "" {
+		retries, err := envInt("HOOK_RETRIES")
+		if err != nil || retries < 0 {
+			return cfg, errors.New(fmt.Sprintf("Invalid value for HOOK_RETRIES: %s", os.Getenv("HOOK_RETRIES")))
+		}
+		cfg.Retries = int(retries)
+	}
+	if os.Getenv("HOOK_WORKERS") != "" {
+		workers, err := envInt("HOOK_WORKERS")
+		if err != nil || workers < 1 {
+			return cfg, errors.New(fmt.Sprintf("Invalid value for HOOK_WORKERS: %s", os.Getenv("HOOK_WORKERS")))
+		}
+		cfg.Workers = int(workers)
+	}
+	if os.Getenv("HOOK_SUSPEND_AFTER") != "" {
+		suspendAfter, err := envInt("HOOK_SUSPEND_AFTER")
+		if err != nil || suspendAfter < 0 {
+			return cfg, errors.New(fmt.Sprintf("Invalid value for HOOK_SUSPEND_AFTER: %s", os.Getenv("HOOK_SUSPEND_AFTER")))
+		}
+		cfg.SuspendAfter = int(suspendAfter)
+	}
+	if os.Getenv("HOOK_MAX_PER_TARGET") != "" {
+		maxPerTarget, err := envInt("HOOK_MAX_PER_TARGET")
+		if err != nil || maxPerTarget < 0 {
+			return cfg, errors.New(fmt.Sprintf("Invalid value for HOOK_MAX_PER_TARGET: %s", os.Getenv("HOOK_MAX_PER_TARGET")))
+		}
+		cfg.MaxPerTarget = int(maxPerTarget)
+	}
+	durations := []struct {
+		Name  string
+		Value *time.Duration
+	}{
+		{"HOOK_BACKOFF", &cfg.Backoff},
+		{"HOOK_MAX_BACKOFF", &cfg.MaxBackoff},
+		{"HOOK_TIMEOUT", &cfg.Timeout},
+	}
+	for _, d := range durations {
+		value, err := envDuration(d.Name)
+		if err != nil {
+			return cfg, err
+		}
+		if value > 0 {
+			*d.Value = value
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// sets the environment variables, returns a function restoring them
+func setEnv(vars map[string]string) func() {
+	old := map[string]string{}
+	for k, v := range vars {
+		old[k] = os.Getenv(k)
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range old {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+func TestRedisConfigFromEnv(t *testing.T) {
+	restore := setEnv(map[string]string{
+		"REDIS_ADDR":            "redis.example.com:6380",
+		"REDIS_PASSWORD":        "secret",
+		"REDIS_DB":              "3",
+		"REDIS_POOL_SIZE":       "20",
+		"REDIS_READ_TIMEOUT":    "2s",
+		"REDIS_PREFIX":          "gobus1",
+		"REDIS_TLS":             "true",
+		"REDIS_TLS_SKIP_VERIFY": "1",
+	})
+	defer restore()
+
+	cfg, err := redisConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != "redis.example.com:6380" || cfg.Password != "secret" || cfg.Prefix != "gobus1" {
+		t.Error("Strings not read", cfg)
+	}
+	if cfg.DB != 3 || cfg.PoolSize != 20 {
+		t.Error("Numbers not read", cfg)
+	}
+	if cfg.ReadTimeout != 2*time.Second || cfg.WriteTimeout != 0 {
+		t.Error("Durations not read", cfg)
+	}
+	if cfg.TLS == nil || !cfg.TLS.InsecureSkipVerify {
+		t.Error("TLS not read", cfg)
+	}
+}
+
+func TestRedisConfigFromEnvInvalid(t *testing.T) {
+	for _, name := range []string{"REDIS_DB", "REDIS_POOL_SIZE", "REDIS_DIAL_TIMEOUT", "REDIS_TLS"} {
+		restore := setEnv(map[string]string{name: "blup"})
+		if _, err := redisConfigFromEnv(); err == nil {
+			t.Error("Invalid value accepted", name)
+		}
+		restore()
+	}
+}
+
+func TestBaseURLFromEnv(t *testing.T) {
+	restore := setEnv(map[string]string{"BASE_URL": ""})
+	defer restore()
+	if u, err := baseURLFromEnv("9090"); err != nil || u.String() != "http://localhost:9090/" {
+		t.Error("Default base URL wrong", u, err)
+	}
+	os.Setenv("BASE_URL", "https://bus.example.com/gobus")
+	if u, err := baseURLFromEnv("9090"); err != nil || u.String() != "https://bus.example.com/gobus/" {
+		t.Error("Base URL wrong", u, err)
+	}
+	os.Setenv("BASE_URL", "/gobus")
+	if _, err := baseURLFromEnv("9090"); err == nil {
+		t.Error("Base URL without host accepted")
+	}
+}
+
+func TestDeliveryConfigFromEnv(t *testing.T) {
+	restore := setEnv(map[string]string{
+		"HOOK_RETRIES":       "3",
+		"HOOK_BACKOFF":       "2s",
+		"HOOK_MAX_BACKOFF":   "",
+		"HOOK_TIMEOUT":       "30s",
+		"HOOK_WORKERS":       "20",
+		"HOOK_SUSPEND_AFTER": "0",
+	})
+	defer restore()
+
+	cfg, err := deliveryConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Retries != 3 || cfg.Backoff != 2*time.Second || cfg.MaxBackoff != defaultDeliveryConfig().MaxBackoff || cfg.Timeout != 30*time.Second {
+		t.Error("Wrong delivery config", cfg)
+	}
+	if cfg.Workers != 20 || cfg.MaxPerTarget != defaultDeliveryConfig().MaxPerTarget || cfg.SuspendAfter != 0 {
+		t.Error("Wrong delivery limits", cfg)
+	}
+
+	os.Setenv("HOOK_RETRIES", "-1")
+	if _, err := deliveryConfigFromEnv(); err == nil {
+		t.Error("Invalid retries accepted")
+	}
+	os.Setenv("HOOK_RETRIES", "")
+	os.Setenv("HOOK_WORKERS", "0")
+	if _, err := deliveryConfigFromEnv(); err == nil {
+		t.Error("Invalid workers accepted")
+	}
+}
@@ -0,0 +1,848 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// creates an empty GoBusDB for a conformance test
+// the returned function is called when the test is done
+type dbFactory func(t *testing.T) (GoBusDB, func())
+
+// a single conformance test
+type conformanceTest struct {
+	Name string
+	Run  func(t *testing.T, db GoBusDB)
+}
+
+var conformanceTests = []conformanceTest{
+	{"CreateItem", testConformanceCreateItem},
+	{"CreateWithValue", testConformanceCreateWithValue},
+	{"CreateIntermediate", testConformanceCreateIntermediate},
+	{"CreateExisting", testConformanceCreateExisting},
+	{"CreateIllegalName", testConformanceCreateIllegalName},
+	{"CreateIllegalLeavesNothing", testConformanceCreateIllegalLeavesNothing},
+	{"ResourceExists", testConformanceResourceExists},
+	{"GetInexisting", testConformanceGetInexisting},
+	{"Delete", testConformanceDelete},
+	{"DeleteInexisting", testConformanceDeleteInexisting},
+	{"DeleteNonLeaf", testConformanceDeleteNonLeaf},
+	{"Value", testConformanceValue},
+	{"AddToCollection", testConformanceAddToCollection},
+	{"AddToItem", testConformanceAddToItem},
+	{"Version", testConformanceVersion},
+	{"SetValueIfVersion", testConformanceSetValueIfVersion},
+	{"SetValueDeleted", testConformanceSetValueDeleted},
+	{"DeleteIfVersion", testConformanceDeleteIfVersion},
+	{"Expiry", testConformanceExpiry},
+	{"ExpiryWithValue", testConformanceExpiryWithValue},
+	{"DeleteIfExpired", testConformanceDeleteIfExpired},
+	{"History", testConformanceHistory},
+	{"HistoryDepth", testConformanceHistoryDepth},
+	{"Hooks", testConformanceHooks},
+	{"HookIDs", testConformanceHookIDs},
+	{"DeleteHook", testConformanceDeleteHook},
+	{"DeleteRemovesHooks", testConformanceDeleteRemovesHooks},
+	{"Forward", testConformanceForward},
+	{"Deliveries", testConformanceDeliveries},
+	{"FinishSchedulesNext", testConformanceFinishSchedulesNext},
+	{"QueueLease", testConformanceQueueLease},
+	{"DeadLetters", testConformanceDeadLetters},
+	{"DeliveryLog", testConformanceDeliveryLog},
+}
+
+// runs all conformance tests against the backend created by newDB
+func runConformance(t *testing.T, newDB dbFactory) {
+	for _, ct := range conformanceTests {
+		run := ct.Run
+		t.Run(ct.Name, func(t *testing.T) {
+			db, teardown := newDB(t)
+			defer teardown()
+			run(t, db)
+		})
+	}
+}
+
+func testConformanceCreateItem(t *testing.T, db GoBusDB) {
+	elts := []string{"level0"}
+	res, err := db.CreateResource(elts, true, "", nil, time.Time{})
+	if err != nil {
+		t.Fatal("Create failed", err)
+	}
+	if item, _ := res.IsItem(); !item {
+		t.Error("Item not properly set")
+	}
+	if name, _ := res.Name(); name != "level0" {
+		t.Error("Name not properly set")
+	}
+	if !testSamePath(res.GetElts(), elts) {
+		t.Error("Elts not properly set")
+	}
+}
+
+func testConformanceCreateWithValue(t *testing.T, db GoBusDB) {
+	elts := []string{"level0", "level1"}
+	res, err := db.CreateResource(elts, true, "text/plain", []byte("some data"), time.Time{})
+	if err != nil {
+		t.Fatal("Create failed", err)
+	}
+	ct, value, err := res.GetValue()
+	if err != nil || ct != "text/plain" || !bytes.Equal(value, []byte("some data")) {
+		t.Error("Initial value not properly set", ct, string(value), err)
+	}
+	parent, _ := db.GetResource([]string{"level0"})
+	if ct, value, _ := parent.GetValue(); ct != "" || len(value) != 0 {
+		t.Error("Initial value set on intermediate resource", ct, string(value))
+	}
+}
+
+func testConformanceCreateIntermediate(t *testing.T, db GoBusDB) {
+	elts := []string{"level0", "level1", "level2"}
+	if _, err := db.CreateResource(elts, true, "", nil, time.Time{}); err != nil {
+		t.Fatal("Create failed", err)
+	}
+	root, _ := db.GetResource([]string{})
+	if children, _ := root.GetChildren(); len(children) != 1 {
+		t.Error("Child of root not properly inserted", children)
+	}
+	for i := range elts[:len(elts)-1] {
+		res, err := db.GetResource(elts[:i+1])
+		if err != nil {
+			t.Fatal("Intermediate resource not created", i)
+		}
+		if item, _ := res.IsItem(); item {
+			t.Error("Intermediate resource is not a collection", i)
+		}
+		if name, _ := res.Name(); name != elts[i] {
+			t.Error("Intermediate resource not properly named", i)
+		}
+		children, _ := res.GetChildren()
+		if len(children) != 1 || !strings.HasSuffix(children[0], ":"+elts[i+1]) {
+			t.Error("Intermediate child not properly inserted", i, children)
+		}
+	}
+
+	// a second resource reuses the existing intermediates
+	db.CreateResource([]string{"level0", "other"}, false, "", nil, time.Time{})
+	res, _ := db.GetResource([]string{"level0"})
+	if children, _ := res.GetChildren(); len(children) != 2 {
+		t.Error("Intermediate resource recreated", children)
+	}
+}
+
+func testConformanceCreateExisting(t *testing.T, db GoBusDB) {
+	elts := []string{"level0", "level1"}
+	res, _ := db.CreateResource(elts, true, "", nil, time.Time{})
+	res.SetValue("text", []byte("bla"))
+	if _, err := db.CreateResource(elts, false, "", nil, time.Time{}); err != errResourceExists {
+		t.Error("Should not be able to create an existing resource", err)
+	}
+	res, _ = db.GetResource(elts)
+	if item, _ := res.IsItem(); !item {
+		t.Error("Existing resource modified")
+	}
+	if _, value, _ := res.GetValue(); !bytes.Equal(value, []byte("bla")) {
+		t.Error("Existing value modified")
+	}
+}
+
+func testConformanceCreateIllegalName(t *testing.T, db GoBusDB) {
+	for _, elts := range [][]string{
+		{"level0", "_hooks"},
+		{"level0", "_forward"},
+		{"level0-lock"},
+	} {
+		if _, err := db.CreateResource(elts, false, "", nil, time.Time{}); err == nil {
+			t.Error("Should not be able to create", elts)
+		}
+	}
+}
+
+func testConformanceCreateIllegalLeavesNothing(t *testing.T, db GoBusDB) {
+	if _, err := db.CreateResource([]string{"other", "level1-lock"}, false, "", nil, time.Time{}); err == nil {
+		t.Error("Should not be able to create a resource including -lock")
+	}
+	if exists, _ := db.ResourceExists([]string{"other"}); exists {
+		t.Error("failed create left intermediate resource")
+	}
+	root, _ := db.GetResource([]string{})
+	if children, _ := root.GetChildren(); len(children) != 0 {
+		t.Error("failed create registered a child of root", children)
+	}
+}
+
+func testConformanceResourceExists(t *testing.T, db GoBusDB) {
+	db.CreateResource([]string{"level0", "level1"}, true, "", nil, time.Time{})
+	if exists, err := db.ResourceExists([]string{"level0", "level1"}); !exists || err != nil {
+		t.Error("Existing resource not found", err)
+	}
+	if exists, err := db.ResourceExists([]string{"level0", "other"}); exists || err != nil {
+		t.Error("Inexisting resource found", err)
+	}
+	if _, err := db.ResourceExists([]string{"level0", "_hooks"}); err == nil {
+		t.Error("Illegal name accepted")
+	}
+}
+
+func testConformanceGetInexisting(t *testing.T, db GoBusDB) {
+	db.CreateResource([]string{"level0"}, false, "", nil, time.Time{})
+	if _, err := db.GetResource([]string{"level0", "level1"}); err == nil {
+		t.Error("found but should not")
+	}
+}
+
+func testConformanceDelete(t *testing.T, db GoBusDB) {
+	elts := []string{"level0", "level1"}
+	res, _ := db.CreateResource(elts, true, "", nil, time.Time{})
+	if err := res.Delete(); err != nil {
+		t.Fatal("delete error", err)
+	}
+	if exists, _ := db.ResourceExists(elts); exists {
+		t.Error("Resource still exists")
+	}
+	parent, _ := db.GetResource([]string{"level0"})
+	if children, _ := parent.GetChildren(); len(children) != 0 {
+		t.Error("Child key not removed", children)
+	}
+}
+
+func testConformanceDeleteInexisting(t *testing.T, db GoBusDB) {
+	res, _ := db.CreateResource([]string{"level0", "level1"}, true, "", nil, time.Time{})
+	res.Delete()
+	parent, _ := db.GetResource([]string{"level0"})
+	version, _ := parent.Version()
+	if err := res.Delete(); err == nil {
+		t.Error("Delete of an inexisting resource succeeded")
+	}
+	if v, _ := parent.Version(); v != version {
+		t.Error("Delete of an inexisting resource changed the parent")
+	}
+}
+
+func testConformanceDeleteNonLeaf(t *testing.T, db GoBusDB) {
+	db.CreateResource([]string{"level0", "level1"}, true, "", nil, time.Time{})
+	res, _ := db.GetResource([]string{"level0"})
+	if err := res.Delete(); err == nil {
+		t.Error("delete should not be possible on non-leaf resources")
+	}
+	if exists, _ := db.ResourceExists([]string{"level0"}); !exists {
+		t.Error("non-leaf resource deleted")
+	}
+}
+
+func testConformanceValue(t *testing.T, db GoBusDB) {
+	res, _ := db.CreateResource([]string{"level0"}, true, "", nil, time.Time{})
+	if _, value, err := res.GetValue(); err != nil || len(value) != 0 {
+		t.Error("new item not empty", err)
+	}
+	if err := res.SetValue("text/plain", []byte("some data àL")); err != nil {
+		t.Fatal("SetValue failed", err)
+	}
+	res, _ = db.GetResource([]string{"level0"})
+	ct, value, err := res.GetValue()
+	if err != nil || ct != "text/plain" || !bytes.Equal(value, []byte("some data àL")) {
+		t.Error("Value not properly set", ct, string(value), err)
+	}
+}
+
+func testConformanceAddToCollection(t *testing.T, db GoBusDB) {
+	res, _ := db.CreateResource([]string{"level0"}, false, "", nil, time.Time{})
+	for i, id := range []string{"0", "1"} {
+		data := []byte("bla" + id)
+		name, err := res.AddToCollection("text", data, time.Time{})
+		if err != nil || name != id {
+			t.Fatal("add index wrong", i, name, err)
+		}
+		child, err := db.GetResource([]string{"level0", id})
+		if err != nil {
+			t.Fatal("child not created", i)
+		}
+		if item, _ := child.IsItem(); !item {
+			t.Error("child is not an item", i)
+		}
+		if ct, value, _ := child.GetValue(); ct != "text" || !bytes.Equal(value, data) {
+			t.Error("wrong data after add", i)
+		}
+	}
+	if children, _ := res.GetChildren(); len(children) != 2 {
+		t.Error("children not registered", children)
+	}
+}
+
+func testConformanceAddToItem(t *testing.T, db GoBusDB) {
+	res, _ := db.CreateResource([]string{"level0"}, true, "", nil, time.Time{})
+	if _, err := res.AddToCollection("text", []byte("bla"), time.Time{}); err == nil {
+		t.Error("add to an item should fail")
+	}
+	if children, _ := res.GetChildren(); len(children) != 0 {
+		t.Error("failed add created a child")
+	}
+}
+
+func testConformanceVersion(t *testing.T, db GoBusDB) {
+	coll, _ := db.CreateResource([]string{"level0"}, false, "", nil, time.Time{})
+	v0, err := coll.Version()
+	if err != nil {
+		t.Fatal("Version failed", err)
+	}
+	coll.AddToCollection("text", []byte("bla"), time.Time{})
+	v1, _ := coll.Version()
+	if v1 == v0 {
+		t.Error("Version not changed by AddToCollection")
+	}
+	item, _ := db.CreateResource([]string{"level0", "item"}, true, "", nil, time.Time{})
+	v2, _ := coll.Version()
+	if v2 == v1 {
+		t.Error("Version not changed by CreateResource")
+	}
+	i0, _ := item.Version()
+	item.SetValue("text", []byte("bla"))
+	i1, _ := item.Version()
+	if i1 == i0 {
+		t.Error("Version not changed by SetValue")
+	}
+	item.AddHook([]byte(`{"name": "hook_name", "url": "http://www.test.ch/my/resource"}`))
+	item.AddForward([]byte(`{"url": "http://blup.com/a/hook"}`))
+	if i2, _ := item.Version(); i2 != i1 {
+		t.Error("Version changed by hooks or forwards")
+	}
+	item.DeleteForward()
+	item.Delete()
+	if v3, _ := coll.Version(); v3 == v2 {
+		t.Error("Version not changed by Delete")
+	}
+	time.Sleep(time.Millisecond) // initial versions are based on the creation time in µs
+	recreated, _ := db.CreateResource([]string{"level0", "item"}, true, "", nil, time.Time{})
+	if r0, _ := recreated.Version(); r0 >= i0 && r0 <= i1 {
+		t.Error("Recreated resource repeats a version of the deleted one", r0)
+	}
+}
+
+func testConformanceSetValueIfVersion(t *testing.T, db GoBusDB) {
+	res, _ := db.CreateResource([]string{"level0"}, true, "", nil, time.Time{})
+	version, _ := res.Version()
+	newVersion, err := res.SetValueIfVersion("text", []byte("bla"), version, time.Time{})
+	if err != nil {
+		t.Fatal("SetValueIfVersion failed", err)
+	}
+	if v, _ := res.Version(); v != newVersion || v == version {
+		t.Error("New version not returned", v, newVersion)
+	}
+	if _, err := res.SetValueIfVersion("text", []byte("blup"), version, time.Time{}); err != errVersionMismatch {
+		t.Error("Outdated version accepted", err)
+	}
+	if _, value, _ := res.GetValue(); !bytes.Equal(value, []byte("bla")) {
+		t.Error("Value modified by failed SetValueIfVersion")
+	}
+	if _, err := res.SetValueIfVersion("text", []byte("blup"), anyVersion, time.Time{}); err != nil {
+		t.Error("anyVersion not accepted", err)
+	}
+}
+
+func testConformanceSetValueDeleted(t *testing.T, db GoBusDB) {
+	res, _ := db.CreateResource([]string{"level0"}, true, "", nil, time.Time{})
+	res.Delete()
+	if err := res.SetValue("text", []byte("bla")); err == nil {
+		t.Error("Value of a deleted resource set")
+	}
+	if exists, _ := db.ResourceExists([]string{"level0"}); exists {
+		t.Error("Deleted resource revived by SetValue")
+	}
+	recreated, err := db.CreateResource([]string{"level0"}, true, "", nil, time.Time{})
+	if err != nil {
+		t.Fatal("Resource not recreated", err)
+	}
+	if isItem, err := recreated.IsItem(); err != nil || !isItem {
+		t.Error("Recreated resource broken", isItem, err)
+	}
+}
+
+func testConformanceDeleteIfVersion(t *testing.T, db GoBusDB) {
+	res, _ := db.CreateResource([]string{"level0"}, true, "", nil, time.Time{})
+	version, _ := res.Version()
+	res.SetValue("text", []byte("bla"))
+	if err := res.DeleteIfVersion(version); err != errVersionMismatch {
+		t.Error("Outdated version accepted", err)
+	}
+	version, _ = res.Version()
+	if err := res.DeleteIfVersion(version); err != nil {
+		t.Error("DeleteIfVersion failed", err)
+	}
+	if exists, _ := db.ResourceExists([]string{"level0"}); exists {
+		t.Error("Resource not deleted")
+	}
+}
+
+func testConformanceHistory(t *testing.T, db GoBusDB) {
+	res, _ := db.CreateResource([]string{"level0"}, true, "", nil, time.Time{})
+	res.SetValue("text", []byte("untracked"))
+	if revisions, err := res.GetHistory(); err != nil || len(revisions) != 0 {
+		t.Error("History kept without depth", revisions, err)
+	}
+	if err := res.SetHistoryDepth(2); err != nil {
+		t.Fatal("SetHistoryDepth failed", err)
+	}
+	if depth, _ := res.GetHistoryDepth(); depth != 2 {
+		t.Error("History depth not set", depth)
+	}
+	versions := []int64{}
+	for _, value := range []string{"a", "b", "c"} {
+		version, _ := res.SetValueIfVersion("text/"+value, []byte(value), anyVersion, time.Time{})
+		versions = append(versions, version)
+	}
+	revisions, err := res.GetHistory()
+	if err != nil || len(revisions) != 2 {
+		t.Fatal("History not trimmed to depth", revisions, err)
+	}
+	if revisions[0].Version != versions[2] || revisions[1].Version != versions[1] {
+		t.Error("History not ordered newest first", revisions)
+	}
+	revision, err := res.GetRevision(versions[1])
+	if err != nil || revision.ContentType != "text/b" || !bytes.Equal(revision.Value, []byte("b")) {
+		t.Error("Revision not returned", revision, err)
+	}
+	if revision.Time.IsZero() {
+		t.Error("Revision time not set")
+	}
+	if _, err := res.GetRevision(versions[0]); err != errRevisionNotFound {
+		t.Error("Trimmed revision returned", err)
+	}
+}
+
+func testConformanceHistoryDepth(t *testing.T, db GoBusDB) {
+	res, _ := db.CreateResource([]string{"level0"}, true, "", nil, time.Time{})
+	res.SetHistoryDepth(3)
+	for _, value := range []string{"a", "b", "c"} {
+		res.SetValue("text", []byte(value))
+	}
+	res.SetHistoryDepth(1)
+	if revisions, _ := res.GetHistory(); len(revisions) != 1 || !bytes.Equal(revisions[0].Value, []byte("c")) {
+		t.Error("History not trimmed on new depth", revisions)
+	}
+	res.SetHistoryDepth(0)
+	if revisions, _ := res.GetHistory(); len(revisions) != 0 {
+		t.Error("History not removed", revisions)
+	}
+	if err := res.SetHistoryDepth(-1); err == nil {
+		t.Error("Negative depth accepted")
+	}
+	res.SetHistoryDepth(1)
+	res.SetValue("text", []byte("d"))
+	res.Delete()
+	res, _ = db.CreateResource([]string{"level0"}, true, "", nil, time.Time{})
+	if revisions, _ := res.GetHistory(); len(revisions) != 0 {
+		t.Error("History not deleted with resource", revisions)
+	}
+}
+
+func testConformanceExpiry(t *testing.T, db GoBusDB) {
+	res, _ := db.CreateResource([]string{"level0", "item"}, true, "", nil, time.Time{})
+	if expires, err := res.GetExpiry(); err != nil || !expires.IsZero() {
+		t.Error("New resource expires", expires, err)
+	}
+	now := time.Now()
+	if err := res.SetExpiry(now.Add(time.Minute)); err != nil {
+		t.Fatal("SetExpiry failed", err)
+	}
+	if expires, _ := res.GetExpiry(); expires.Sub(now.Add(time.Minute)) > time.Millisecond {
+		t.Error("Expiry not set", expires)
+	}
+	if expired, _ := db.ExpiredResources(now); len(expired) != 0 {
+		t.Error("Resource expired too early", expired)
+	}
+	expired, err := db.ExpiredResources(now.Add(2 * time.Minute))
+	if err != nil || len(expired) != 1 || !testSamePath(expired[0], []string{"level0", "item"}) {
+		t.Error("Expired resource not returned", expired, err)
+	}
+	res.SetExpiry(time.Time{})
+	if expires, _ := res.GetExpiry(); !expires.IsZero() {
+		t.Error("Expiry not removed", expires)
+	}
+	if expired, _ := db.ExpiredResources(now.Add(2 * time.Minute)); len(expired) != 0 {
+		t.Error("Removed expiry still listed", expired)
+	}
+	res.SetExpiry(now)
+	res.Delete()
+	if expired, _ := db.ExpiredResources(now.Add(2 * time.Minute)); len(expired) != 0 {
+		t.Error("Deleted resource still listed", expired)
+	}
+}
+
+func testConformanceExpiryWithValue(t *testing.T, db GoBusDB) {
+	expires := time.Now().Add(time.Minute)
+	later := expires.Add(2 * time.Minute)
+	item, err := db.CreateResource([]string{"level0", "item"}, true, "text", []byte("bla"), expires)
+	if err != nil {
+		t.Fatal("Create failed", err)
+	}
+	if got, _ := item.GetExpiry(); got.Sub(expires) > time.Millisecond {
+		t.Error("Expiry not set on create", got)
+	}
+	coll, _ := db.GetResource([]string{"level0"})
+	name, err := coll.AddToCollection("text", []byte("bla"), expires)
+	if err != nil {
+		t.Fatal("AddToCollection failed", err)
+	}
+	child, _ := db.GetResource([]string{"level0", name})
+	if got, _ := child.GetExpiry(); got.Sub(expires) > time.Millisecond {
+		t.Error("Expiry not set on add", got)
+	}
+	if expired, _ := db.ExpiredResources(expires.Add(time.Second)); len(expired) != 2 {
+		t.Error("Expiring resources not listed", expired)
+	}
+
+	// the zero time keeps the expiry
+	item.SetValueIfVersion("text", []byte("blup"), anyVersion, time.Time{})
+	if got, _ := item.GetExpiry(); got.Sub(expires) > time.Millisecond {
+		t.Error("Expiry changed by a value without expiry", got)
+	}
+	item.SetValueIfVersion("text", []byte("blup"), anyVersion, later)
+	if got, _ := item.GetExpiry(); got.Sub(later) > time.Millisecond {
+		t.Error("Expiry not set with the value", got)
+	}
+	expired, _ := db.ExpiredResources(expires.Add(time.Second))
+	if len(expired) != 1 || !testSamePath(expired[0], []string{"level0", name}) {
+		t.Error("Expiry set with the value not listed", expired)
+	}
+
+	// a failed set leaves the expiry alone
+	if _, err := item.SetValueIfVersion("text", []byte("blip"), 0, expires); err != errVersionMismatch {
+		t.Error("SetValueIfVersion with a wrong version succeeded", err)
+	}
+	if got, _ := item.GetExpiry(); got.Sub(later) > time.Millisecond {
+		t.Error("Expiry changed by a failed set", got)
+	}
+}
+
+func testConformanceDeleteIfExpired(t *testing.T, db GoBusDB) {
+	res, _ := db.CreateResource([]string{"level0", "item"}, true, "", nil, time.Time{})
+	now := time.Now()
+	if deleted, err := res.DeleteIfExpired(now); deleted || err != nil {
+		t.Error("Resource without expiry deleted", err)
+	}
+	res.SetExpiry(now.Add(time.Minute))
+	if deleted, err := res.DeleteIfExpired(now); deleted || err != nil {
+		t.Error("Resource deleted before its expiry", err)
+	}
+	if exists, _ := db.ResourceExists([]string{"level0", "item"}); !exists {
+		t.Error("Unexpired resource removed")
+	}
+	if deleted, err := res.DeleteIfExpired(now.Add(2 * time.Minute)); !deleted || err != nil {
+		t.Error("Expired resource not deleted", err)
+	}
+	if exists, _ := db.ResourceExists([]string{"level0", "item"}); exists {
+		t.Error("Expired resource still exists")
+	}
+	if expired, _ := db.ExpiredResources(now.Add(2 * time.Minute)); len(expired) != 0 {
+		t.Error("Deleted resource still listed", expired)
+	}
+	if deleted, err := res.DeleteIfExpired(now.Add(2 * time.Minute)); deleted || err == nil {
+		t.Error("Inexisting resource deleted")
+	}
+}
+
+func testConformanceHooks(t *testing.T, db GoBusDB) {
+	res, _ := db.CreateResource([]string{"level0"}, true, "", nil, time.Time{})
+	id, err := res.AddHook([]byte(`{"name": "hook_name", "url": "http://www.test.ch/my/resource"}`))
+	if err != nil {
+		t.Fatal("Hook Add failed", err)
+	}
+	hook, err := res.GetHook(id)
+	if err != nil || hook.Id != id || hook.Name != "hook_name" || hook.URL != "http://www.test.ch/my/resource" {
+		t.Error("Get returned wrong hook", hook, err)
+	}
+	err = res.SetHook(id, []byte(`{"id": "other", "name": "new_name", "url": "http://blup.com"}`))
+	if err != nil {
+		t.Fatal("Hook Set failed", err)
+	}
+	hooks, err := res.GetHooks()
+	if err != nil || len(hooks) != 1 {
+		t.Fatal("GetHooks failed", err)
+	}
+	if hooks[0].Id != id || hooks[0].Name != "new_name" {
+		t.Error("Set not working", hooks[0])
+	}
+	if _, err := res.GetHook("99"); err == nil {
+		t.Error("Got inexisting hook")
+	}
+	if _, err := res.AddHook([]byte(`no json`)); err == nil {
+		t.Error("Invalid hook accepted")
+	}
+}
+
+func testConformanceHookIDs(t *testing.T, db GoBusDB) {
+	res, _ := db.CreateResource([]string{"level0"}, false, "", nil, time.Time{})
+	hookData := []byte(`{"name": "hook_name", "url": "http://www.test.ch/my/resource"}`)
+	for _, expected := range []string{"0", "1", "2"} {
+		if id, _ := res.AddHook(hookData); id != expected {
+			t.Error("Hook Id not allocated", expected, id)
+		}
+	}
+	res.DeleteHook("2")
+	if id, _ := res.AddHook(hookData); id != "3" {
+		t.Error("Hook Id reused", id)
+	}
+	ids, err := res.GetHooksIDs()
+	if err != nil || len(ids) != 3 {
+		t.Error("GetHooksIDs failed", ids, err)
+	}
+}
+
+func testConformanceDeleteHook(t *testing.T, db GoBusDB) {
+	res, _ := db.CreateResource([]string{"level0"}, true, "", nil, time.Time{})
+	id, _ := res.AddHook([]byte(`{"name": "hook_name", "url": "http://www.test.ch/my/resource"}`))
+	if err := res.DeleteHook(id); err != nil {
+		t.Error("Hook Delete failed", err)
+	}
+	if err := res.DeleteHook(id); err == nil {
+		t.Error("Hook Delete Inexisting failed")
+	}
+	if hooks, _ := res.GetHooks(); len(hooks) != 0 {
+		t.Error("Hook not deleted")
+	}
+}
+
+func testConformanceDeleteRemovesHooks(t *testing.T, db GoBusDB) {
+	elts := []string{"level0"}
+	res, _ := db.CreateResource(elts, true, "", nil, time.Time{})
+	res.AddHook([]byte(`{"name": "hook_name", "url": "http://www.test.ch/my/resource"}`))
+	res.Delete()
+	res, _ = db.CreateResource(elts, true, "", nil, time.Time{})
+	if hooks, _ := res.GetHooks(); len(hooks) != 0 {
+		t.Error("Hooks survived delete")
+	}
+}
+
+func testConformanceForward(t *testing.T, db GoBusDB) {
+	elts := []string{"level0"}
+	res, _ := db.CreateResource(elts, false, "", nil, time.Time{})
+	if f, err := res.GetForward(); err != nil || f.URL != "" {
+		t.Error("New resource has a forward", err)
+	}
+	if err := res.AddForward([]byte(`{"url": "http://blup.com/a/hook"}`)); err != nil {
+		t.Fatal("AddForward failed", err)
+	}
+	res, _ = db.GetResource(elts)
+	if f, _ := res.GetForward(); f.URL != "http://blup.com/a/hook" {
+		t.Error("Forward not set")
+	}
+	if err := res.AddForward([]byte(`no json`)); err == nil {
+		t.Error("Invalid forward accepted")
+	}
+	if err := res.DeleteForward(); err != nil {
+		t.Fatal("DeleteForward failed", err)
+	}
+	res, _ = db.GetResource(elts)
+	if f, _ := res.GetForward(); f.URL != "" {
+		t.Error("Forward not deleted")
+	}
+}
+
+// queues deliveries with the given payloads, all due at now
+func testEnqueue(t *testing.T, db GoBusDB, queue string, now time.Time, payloads ...string) []*Delivery {
+	deliveries := []*Delivery{}
+	for _, payload := range payloads {
+		d := &Delivery{Payload: []byte(payload), Created: now, NextAttempt: now}
+		if err := db.EnqueueDelivery(queue, d); err != nil {
+			t.Fatal("EnqueueDelivery failed", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries
+}
+
+func testConformanceDeliveries(t *testing.T, db GoBusDB) {
+	now := time.Now()
+	if due, err := db.DueQueues(now); err != nil || len(due) != 0 {
+		t.Error("Empty db has due queues", due, err)
+	}
+	queued := testEnqueue(t, db, "a/_hooks/0", now, `"first"`, `"second"`)
+	if queued[0].ID == "" || queued[0].ID == queued[1].ID {
+		t.Error("No unique IDs set", queued[0].ID, queued[1].ID)
+	}
+	if due, _ := db.DueQueues(now); len(due) != 1 || due[0] != "a/_hooks/0" {
+		t.Error("Queue not due", due)
+	}
+	if depths, err := db.QueueDepths(); err != nil || len(depths) != 1 || depths["a/_hooks/0"] != 2 {
+		t.Error("Wrong queue depths", depths, err)
+	}
+	deliveries, err := db.GetDeliveries("a/_hooks/0")
+	if err != nil || len(deliveries) != 2 || string(deliveries[0].Payload) != `"first"` {
+		t.Fatal("Deliveries not returned in order", deliveries, err)
+	}
+
+	head := deliveries[0]
+	head.Attempts = 1
+	head.LastError = "failed"
+	head.NextAttempt = now.Add(time.Minute)
+	if err := db.RetryDelivery("a/_hooks/0", head); err != nil {
+		t.Fatal("RetryDelivery failed", err)
+	}
+	if due, _ := db.DueQueues(now); len(due) != 0 {
+		t.Error("Retried queue due too early", due)
+	}
+	if due, _ := db.DueQueues(now.Add(2 * time.Minute)); len(due) != 1 {
+		t.Error("Retried queue not due", due)
+	}
+	deliveries, _ = db.GetDeliveries("a/_hooks/0")
+	if deliveries[0].Attempts != 1 || deliveries[0].LastError != "failed" {
+		t.Error("Attempt not stored", deliveries[0])
+	}
+	if err := db.RetryDelivery("a/_hooks/0", deliveries[1]); err != errDeliveryNotFound {
+		t.Error("Retry of a delivery which is not the head accepted", err)
+	}
+
+	if err := db.FinishDelivery("a/_hooks/0", deliveries[0], false); err != nil {
+		t.Fatal("FinishDelivery failed", err)
+	}
+	if deliveries, _ = db.GetDeliveries("a/_hooks/0"); len(deliveries) != 1 || string(deliveries[0].Payload) != `"second"` {
+		t.Error("Finished delivery not removed", deliveries)
+	}
+	if due, _ := db.DueQueues(now.Add(time.Second)); len(due) != 1 {
+		t.Error("Next delivery not due", due)
+	}
+	db.FinishDelivery("a/_hooks/0", deliveries[0], false)
+	if due, _ := db.DueQueues(now.Add(time.Hour)); len(due) != 0 {
+		t.Error("Empty queue still due", due)
+	}
+	if depths, _ := db.QueueDepths(); len(depths) != 0 {
+		t.Error("Empty queue has a depth", depths)
+	}
+	if deadLetters, _ := db.GetDeadLetters("a/_hooks/0"); len(deadLetters) != 0 {
+		t.Error("Delivered events stored as dead letters", deadLetters)
+	}
+
+	for i := 0; i < 2; i++ {
+		d := &Delivery{Payload: []byte(`"batched"`), Created: now, NextAttempt: now.Add(time.Hour), Batch: 2}
+		db.EnqueueDelivery("a/_hooks/2", d)
+		if due, _ := db.DueQueues(now.Add(time.Second)); (len(due) == 1) != (i == 1) {
+			t.Error("Batched queue due before its delay or not due when full", i, due)
+		}
+	}
+	db.DeleteDeliveries("a/_hooks/2")
+
+	testEnqueue(t, db, "a/_hooks/1", now, `"other"`)
+	db.DeleteDeliveries("a/_hooks/1")
+	if deliveries, _ := db.GetDeliveries("a/_hooks/1"); len(deliveries) != 0 {
+		t.Error("Deliveries not deleted", deliveries)
+	}
+	if due, _ := db.DueQueues(now.Add(time.Second)); len(due) != 0 {
+		t.Error("Deleted queue still due", due)
+	}
+}
+
+func testConformanceFinishSchedulesNext(t *testing.T, db GoBusDB) {
+	now := time.Now()
+	first := testEnqueue(t, db, "a/_hooks/0", now, `"first"`)
+	testEnqueue(t, db, "a/_hooks/0", now.Add(time.Hour), `"later"`)
+	if err := db.FinishDelivery("a/_hooks/0", first[0], false); err != nil {
+		t.Fatal("FinishDelivery failed", err)
+	}
+	if due, _ := db.DueQueues(now.Add(time.Minute)); len(due) != 0 {
+		t.Error("Next delivery due before its attempt", due)
+	}
+	if due, _ := db.DueQueues(now.Add(2 * time.Hour)); len(due) != 1 {
+		t.Error("Next delivery not due", due)
+	}
+}
+
+func testConformanceQueueLease(t *testing.T, db GoBusDB) {
+	if leased, err := db.LeaseQueue("a/_hooks/0", "owner", time.Minute); err != nil || !leased {
+		t.Fatal("Lease not taken", leased, err)
+	}
+	if leased, err := db.LeaseQueue("a/_hooks/0", "owner", time.Minute); err != nil || !leased {
+		t.Error("Lease not extended", leased, err)
+	}
+	if err := db.ReleaseQueue("a/_hooks/0", "owner"); err != nil {
+		t.Error("Lease not released", err)
+	}
+	if leased, err := db.LeaseQueue("a/_hooks/0", "other", time.Minute); err != nil || !leased {
+		t.Error("Released lease not taken", leased, err)
+	}
+	db.ReleaseQueue("a/_hooks/0", "other")
+}
+
+func testConformanceDeadLetters(t *testing.T, db GoBusDB) {
+	now := time.Now()
+	queued := testEnqueue(t, db, "a/_hooks/0", now, `"first"`, `"second"`)
+	queued[0].Attempts = 3
+	queued[0].LastError = "failed"
+	if err := db.FinishDelivery("a/_hooks/0", queued[0], true); err != nil {
+		t.Fatal("FinishDelivery failed", err)
+	}
+	deadLetters, err := db.GetDeadLetters("a/_hooks/0")
+	if err != nil || len(deadLetters) != 1 || deadLetters[0].ID != queued[0].ID || deadLetters[0].Attempts != 3 {
+		t.Fatal("Dead letter not stored", deadLetters, err)
+	}
+
+	if err := db.ReplayDeadLetter("a/_hooks/0", queued[0].ID); err != nil {
+		t.Fatal("ReplayDeadLetter failed", err)
+	}
+	deliveries, _ := db.GetDeliveries("a/_hooks/0")
+	if len(deliveries) != 2 || deliveries[1].ID != queued[0].ID || deliveries[1].Attempts != 0 {
+		t.Error("Dead letter not queued at the end", deliveries)
+	}
+	if deadLetters, _ := db.GetDeadLetters("a/_hooks/0"); len(deadLetters) != 0 {
+		t.Error("Replayed dead letter not removed", deadLetters)
+	}
+	if err := db.ReplayDeadLetter("a/_hooks/0", queued[0].ID); err != errDeliveryNotFound {
+		t.Error("Replay of inexisting dead letter accepted", err)
+	}
+
+	db.FinishDelivery("a/_hooks/0", deliveries[0], true)
+	if err := db.DeleteDeadLetter("a/_hooks/0", deliveries[0].ID); err != nil {
+		t.Error("DeleteDeadLetter failed", err)
+	}
+	if deadLetters, _ := db.GetDeadLetters("a/_hooks/0"); len(deadLetters) != 0 {
+		t.Error("Dead letter not deleted", deadLetters)
+	}
+	if err := db.DeleteDeadLetter("a/_hooks/0", deliveries[0].ID); err != errDeliveryNotFound {
+		t.Error("Delete of inexisting dead letter accepted", err)
+	}
+}
+
+func testConformanceDeliveryLog(t *testing.T, db GoBusDB) {
+	if stats, err := db.GetDeliveryStats("a/_hooks/0"); err != nil || stats.Successes != 0 || stats.Failures != 0 {
+		t.Error("Empty queue has counters", stats, err)
+	}
+	for i := 0; i < maxDeliveryLog+2; i++ {
+		a := &DeliveryAttempt{Time: time.Now(), DeliveryID: strconv.Itoa(i), Event: []byte(`"event"`), Status: http.StatusOK}
+		if i%2 == 1 {
+			a.Status = http.StatusBadGateway
+			a.Error = "failed"
+		}
+		if err := db.LogDeliveryAttempt("a/_hooks/0", a); err != nil {
+			t.Fatal("LogDeliveryAttempt failed", err)
+		}
+	}
+	attempts, err := db.GetDeliveryLog("a/_hooks/0")
+	if err != nil || len(attempts) != maxDeliveryLog {
+		t.Fatal("Delivery log not limited", len(attempts), err)
+	}
+	if attempts[0].DeliveryID != strconv.Itoa(maxDeliveryLog+1) || attempts[0].Status != http.StatusBadGateway || attempts[0].Error != "failed" {
+		t.Error("Newest attempt not first", attempts[0])
+	}
+	if stats, _ := db.GetDeliveryStats("a/_hooks/0"); stats.Successes != maxDeliveryLog/2+1 || stats.Failures != maxDeliveryLog/2+1 || stats.ConsecutiveFailures != 1 {
+		t.Error("Wrong counters", stats)
+	}
+	db.LogDeliveryAttempt("a/_hooks/0", &DeliveryAttempt{Error: "failed"})
+	if stats, _ := db.GetDeliveryStats("a/_hooks/0"); stats.ConsecutiveFailures != 2 {
+		t.Error("Consecutive failures not counted", stats)
+	}
+	db.ResetDeliveryFailures("a/_hooks/0")
+	if stats, _ := db.GetDeliveryStats("a/_hooks/0"); stats.ConsecutiveFailures != 0 || stats.Failures != maxDeliveryLog/2+2 {
+		t.Error("Consecutive failures not reset", stats)
+	}
+
+	db.DeleteDeliveries("a/_hooks/0")
+	if attempts, _ := db.GetDeliveryLog("a/_hooks/0"); len(attempts) != 0 {
+		t.Error("Delivery log not deleted", attempts)
+	}
+	if stats, _ := db.GetDeliveryStats("a/_hooks/0"); stats.Successes != 0 || stats.Failures != 0 {
+		t.Error("Counters not deleted", stats)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// an event waiting to be posted to a hook
+// the URL, the static headers and the signature are taken from the hook when the event is posted
+// undeliverable events are kept as dead letters
+type Delivery struct {
+	ID          string            `json:"id"`
+	Payload     json.RawMessage   `json:"payload"`
+	Created     time.Time         `json:"created"`
+	Attempts    int               `json:"attempts"`
+	NextAttempt time.Time         `json:"nextAttempt"`
+	LastError   string            `json:"lastError,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"` // headers of the format of the event, e.g. of binary CloudEvents
+	Batch       int               `json:"batch,omitempty"`   // maximal number of events posted together with this one, 0 if not batched
+	Hook        *Hook             `json:"hook,omitempty"`    // set for the deletion of the resource of the hook, used once the hook is gone
+}
+
+// an attempt to deliver an event to a hook
+type DeliveryAttempt struct {
+	Time       time.Time       `json:"time"`
+	DeliveryID string          `json:"deliveryId"`
+	Event      json.RawMessage `json:"event"`
+	Status     int             `json:"status,omitempty"` // status of the response, missing if the hook could not be reached
+	Latency    int64           `json:"latency"`          // in ms
+	Error      string          `json:"error,omitempty"`
+}
+
+// counters of the attempts to deliver events to a hook
+type DeliveryStats struct {
+	Successes           int64 `json:"successes"`
+	Failures            int64 `json:"failures"`
+	ConsecutiveFailures int64 `json:"consecutiveFailures"` // failures since the last success
+}
+
+// configuration of the hook delivery
+type DeliveryConfig struct {
+	Retries      int           // number of retries after the first attempt
+	Backoff      time.Duration // wait before the first retry, doubled for every further retry
+	MaxBackoff   time.Duration // longest wait between two retries
+	Timeout      time.Duration // timeout of a single post
+	Workers      int           // number of hooks delivered at once
+	MaxPerTarget int           // maximal number of posts running at once to the same host, 0 for no limit
+	SuspendAfter int           // number of consecutive failed posts after which a hook is suspended, 0 to never suspend
+}
+
+// maximal number of dead letters kept per hook, older ones are dropped
+const maxDeadLetters = 1000
+
+// maximal number of delivery attempts logged per hook, older ones are dropped
+const maxDeliveryLog = 100
+
+// maximal number of events posted together to a batching hook
+const maxBatchSize = 100
+
+var errDeliveryNotFound = errors.New("Delivery not found")
+
+// returns the delivery configuration used if nothing is configured
+func defaultDeliveryConfig() DeliveryConfig {
+	return DeliveryConfig{
+		Retries:      5,
+		Backoff:      time.Second,
+		MaxBackoff:   5 * time.Minute,
+		Timeout:      10 * time.Second,
+		Workers:      10,
+		MaxPerTarget: 4,
+		SuspendAfter: 50,
+	}
+}
+
+// returns the name of the delivery queue of a hook
+func hookQueue(elts []string, hookID string) string {
+	return strings.Join(elts, "/") + "/_hooks/" + hookID
+}
+
+// returns the name of the delivery queue of the hook
+// the serial keeps a new hook from taking over the queue of a deleted hook with the same ID
+func (h *Hook) queue(elts []string) string {
+	queue := hookQueue(elts, h.Id)
+	if h.Serial != "" {
+		queue += "/" + h.Serial
+	}
+	return queue
+}
+
+// returns the elements of the resource, the ID and the serial of the hook of a delivery queue
+func parseHookQueue(queue string) ([]string, string, string) {
+	i := strings.LastIndex(queue, "/_hooks/")
+	if i < 0 {
+		return nil, "", ""
+	}
+	elts := []string{}
+	if i > 0 {
+		elts = strings.Split(queue[:i], "/")
+	}
+	id, serial := queue[i+len("/_hooks/"):], ""
+	if j := strings.Index(id, "/"); j >= 0 {
+		id, serial = id[:j], id[j+1:]
+	}
+	return elts, id, serial
+}
+
+var errHookGone = errors.New("Hook has been deleted")
+
+// returns the hook of a delivery queue and its resource
+// fails with errHookGone if the resource or the hook, with the serial of the queue, does not exist anymore
+func queueHook(db GoBusDB, queue string) (Resource, *Hook, error) {
+	elts, id, serial := parseHookQueue(queue)
+	if len(elts) > 0 {
+		exists, err := db.ResourceExists(elts)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !exists {
+			return nil, nil, errHookGone
+		}
+	}
+	res, err := db.GetResource(elts)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids, err := res.GetHooksIDs()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !contains(ids, id) {
+		return nil, nil, errHookGone
+	}
+	hook, err := res.GetHook(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hook.Serial != serial {
+		return nil, nil, errHookGone
+	}
+	return res, hook, nil
+}
+
+// drops the delivery queue of a deleted hook with its dead letters and log, unless events are waiting
+func dropDrainedQueue(db GoBusDB, queue string) {
+	deliveries, err := db.GetDeliveries(queue)
+	if err == nil && len(deliveries) == 0 {
+		err = db.DeleteDeliveries(queue)
+	}
+	if err != nil {
+		log.Printf("Internal error, could not drop the deliveries of %s: %v", queue, err.Error())
+	}
+}
+
+// returns the wait before the next attempt after the given number of failed attempts
+func (cfg DeliveryConfig) backoff(attempts int) time.Duration {
+	backoff := cfg.Backoff
+	for i := 1; i < attempts && backoff < cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > cfg.MaxBackoff {
+		backoff = cfg.MaxBackoff
+	}
+	return backoff
+}
+
+// returns a copy of a dead letter to be delivered again
+func replayedDelivery(d *Delivery) *Delivery {
+	c := *d
+	c.Attempts = 0
+	c.NextAttempt = time.Now()
+	c.LastError = ""
+	return &c
+}
+
+// checks if the head of a queue starts a full batch which is due before its delay
+func batchFull(deliveries []*Delivery) bool {
+	head := deliveries[0]
+	return head.Batch > 0 && head.Attempts == 0 && len(deliveries) >= head.Batch
+}
+
+// returns the time the head of a non empty queue is due
+// a full batch is due as soon as its last event has been queued
+func queueDue(deliveries []*Delivery) time.Time {
+	head := deliveries[0]
+	if batchFull(deliveries) && deliveries[head.Batch-1].Created.Before(head.NextAttempt) {
+		return deliveries[head.Batch-1].Created
+	}
+	return head.NextAttempt
+}
+
+// returns the deliveries posted together with the head of a queue
+func nextBatch(deliveries []*Delivery) []*Delivery {
+	n := deliveries[0].Batch
+	if n <= 0 {
+		n = 1
+	}
+	if n > len(deliveries) {
+		n = len(deliveries)
+	}
+	return deliveries[:n]
+}
+
+// delivery handlers
+// writes the deliveries as json
+func writeDeliveries(hd *HandlerData, deliveries []*Delivery, err error) {
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get deliveries")
+		return
+	}
+	for _, delivery := range deliveries {
+		delivery.Hook = nil // holds the secret
+	}
+	data, err := json.Marshal(deliveries)
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get deliveries Json")
+		return
+	}
+	hd.W.Write(data)
+}
+
+// returns the events waiting for delivery
+func getQueue(hd *HandlerData, queue string, cmds []string) {
+	if len(cmds) != 3 {
+		respond(hd, http.StatusNotFound, "Not Found")
+		return
+	}
+	if hd.R.Method != "GET" {
+		respond(hd, http.StatusMethodNotAllowed, "Method not allowed for the queue.")
+		return
+	}
+	deliveries, err := hd.DB.GetDeliveries(queue)
+	writeDeliveries(hd, deliveries, err)
+}
+
+// returns the latest delivery attempts, the newest first
+func getDeliveryLog(hd *HandlerData, queue string, cmds []string) {
+	if len(cmds) != 3 {
+		respond(hd, http.StatusNotFound, "Not Found")
+		return
+	}
+	if hd.R.Method != "GET" {
+		respond(hd, http.StatusMethodNotAllowed, "Method not allowed for the deliveries.")
+		return
+	}
+	attempts, err := hd.DB.GetDeliveryLog(queue)
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get delivery log")
+		return
+	}
+	data, err := json.Marshal(attempts)
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get delivery log Json")
+		return
+	}
+	hd.W.Write(data)
+}
+
+// returns either a single dead letter specified by the ID or all dead letters
+func getDeadLetters(hd *HandlerData, queue string, cmds []string) {
+	deadLetters, err := hd.DB.GetDeadLetters(queue)
+	if len(cmds) == 3 || err != nil {
+		writeDeliveries(hd, deadLetters, err)
+		return
+	}
+	for _, d := range deadLetters {
+		if d.ID == cmds[3] {
+			data, err := json.Marshal(d)
+			if err != nil {
+				respond(hd, http.StatusInternalServerError, "Could not get dead letter Json")
+				return
+			}
+			hd.W.Write(data)
+			return
+		}
+	}
+	respond(hd, http.StatusNotFound, "Dead letter not found.")
+}
+
+// applies f to the dead letter specified by the ID or to all dead letters
+func forDeadLetters(hd *HandlerData, queue string, cmds []string, f func(queue, id string) error) error {
+	if len(cmds) == 4 {
+		return f(queue, cmds[3])
+	}
+	deadLetters, err := hd.DB.GetDeadLetters(queue)
+	if err != nil {
+		return err
+	}
+	for _, d := range deadLetters {
+		err = f(queue, d.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queues dead letters for delivery again
+func replayDeadLetters(hd *HandlerData, queue string, cmds []string) {
+	err := forDeadLetters(hd, queue, cmds, hd.DB.ReplayDeadLetter)
+	if err == errDeliveryNotFound {
+		respond(hd, http.StatusNotFound, "Dead letter not found.")
+		return
+	}
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not replay dead letters.")
+		return
+	}
+	wakeDispatchers(hd.DB)
+	respond(hd, http.StatusOK, "Dead letters queued for delivery.")
+}
+
+// drops dead letters
+func deleteDeadLetters(hd *HandlerData, queue string, cmds []string) {
+	err := forDeadLetters(hd, queue, cmds, hd.DB.DeleteDeadLetter)
+	if err == errDeliveryNotFound {
+		respond(hd, http.StatusNotFound, "Dead letter not found.")
+		return
+	}
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not delete dead letters.")
+		return
+	}
+	respond(hd, http.StatusOK, "Deleted")
+}
+
+// handles requests for _hooks/<id>/queue, _hooks/<id>/deliveries and _hooks/<id>/deadletters
+func handleHookDeliveryRequest(hd *HandlerData, res Resource, cmds []string) {
+	hook, err := res.GetHook(cmds[1])
+	if err != nil {
+		respond(hd, http.StatusNotFound, "Not Found")
+		return
+	}
+	queue := hook.queue(res.GetElts())
+	switch cmds[2] {
+	case "queue":
+		getQueue(hd, queue, cmds)
+		return
+	case "deliveries":
+		getDeliveryLog(hd, queue, cmds)
+		return
+	case "deadletters":
+	default:
+		respond(hd, http.StatusNotFound, "Not Found")
+		return
+	}
+	if len(cmds) > 4 {
+		respond(hd, http.StatusNotFound, "Not Found")
+		return
+	}
+	switch hd.R.Method {
+	case "DELETE":
+		deleteDeadLetters(hd, queue, cmds)
+	case "GET":
+		getDeadLetters(hd, queue, cmds)
+	case "POST":
+		replayDeadLetters(hd, queue, cmds)
+	default:
+		respond(hd, http.StatusMethodNotAllowed, "Method not allowed for dead letters.")
+	}
+}
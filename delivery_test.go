@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// starts a dispatcher retrying quickly, returns a function to stop it
+func startTestDispatcher(db GoBusDB) func() {
+	cfg := DeliveryConfig{
+		Retries:      2,
+		Backoff:      10 * time.Millisecond,
+		MaxBackoff:   50 * time.Millisecond,
+		Timeout:      time.Second,
+		Workers:      4,
+		MaxPerTarget: 2,
+	}
+	stop := make(chan bool)
+	go newDispatcher(db, cfg).run(10*time.Millisecond, stop)
+	return func() { close(stop) }
+}
+
+// a hook receiver answering with the status returned by status
+type testReceiver struct {
+	mutex    sync.Mutex
+	status   int
+	attempts int
+	received chan []byte
+}
+
+func newTestReceiver(status int) (*testReceiver, *httptest.Server) {
+	receiver := &testReceiver{status: status, received: make(chan []byte, 10)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receiver.mutex.Lock()
+		receiver.attempts++
+		status := receiver.status
+		receiver.mutex.Unlock()
+		data, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			receiver.received <- data
+		}
+	}))
+	return receiver, server
+}
+
+func (r *testReceiver) setStatus(status int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.status = status
+}
+
+func (r *testReceiver) getAttempts() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.attempts
+}
+
+// waits until f returns true
+func waitFor(t *testing.T, f func() bool, msg string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeliveryBackoff(t *testing.T) {
+	cfg := DeliveryConfig{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, backoff := range expected {
+		if b := cfg.backoff(i + 1); b != backoff {
+			t.Error("Wrong backoff", i+1, b)
+		}
+	}
+}
+
+func TestDeliveryRetry(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"delivery"}, true, "", nil, time.Time{})
+	receiver, server := newTestReceiver(http.StatusServiceUnavailable)
+	defer server.Close()
+	res.AddHook([]byte(fmt.Sprintf(`{"name": "retry", "url": "%s"}`, server.URL)))
+	stop := startTestDispatcher(db)
+	defer stop()
+
+	callHooks(db, res, "PUT", "/")
+	waitFor(t, func() bool { return receiver.getAttempts() >= 2 }, "Delivery not retried")
+	queue := hookQueue(res.GetElts(), "0")
+	if deliveries, _ := db.GetDeliveries(queue); len(deliveries) != 1 || deliveries[0].Attempts == 0 || deliveries[0].LastError == "" {
+		t.Error("Failed attempt not recorded", deliveries)
+	}
+	receiver.setStatus(http.StatusOK)
+	select {
+	case <-receiver.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event not delivered after failure")
+	}
+	waitFor(t, func() bool {
+		deliveries, _ := db.GetDeliveries(queue)
+		return len(deliveries) == 0
+	}, "Delivered event still queued")
+
+	hd := createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/delivery/_hooks/0/deliveries", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Get delivery log: 200 not working")
+	var attempts []*DeliveryAttempt
+	json.Unmarshal(hd.W.(*httptest.ResponseRecorder).Body.Bytes(), &attempts)
+	last := len(attempts) - 1
+	if len(attempts) < 3 || attempts[0].Status != http.StatusOK || attempts[0].Error != "" ||
+		attempts[last].Status != http.StatusServiceUnavailable || attempts[last].Error == "" ||
+		!strings.Contains(string(attempts[0].Event), `"method":"PUT"`) {
+		t.Error("Get delivery log: content not working", hd.W.(*httptest.ResponseRecorder).Body.String())
+	}
+
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/delivery/_hooks/0", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Get hook: 200 not working")
+	var stats DeliveryStats
+	json.Unmarshal(hd.W.(*httptest.ResponseRecorder).Body.Bytes(), &stats)
+	if stats.Successes != 1 || stats.Failures != int64(len(attempts)-1) {
+		t.Error("Get hook: counters not working", hd.W.(*httptest.ResponseRecorder).Body.String())
+	}
+	teardownDB(db)
+}
+
+func TestDeliveryDeadLetters(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"dead"}, true, "", nil, time.Time{})
+	receiver, server := newTestReceiver(http.StatusInternalServerError)
+	defer server.Close()
+	res.AddHook([]byte(fmt.Sprintf(`{"name": "dead", "url": "%s"}`, server.URL)))
+	stop := startTestDispatcher(db)
+	defer stop()
+
+	callHooks(db, res, "PUT", "/")
+	queue := hookQueue(res.GetElts(), "0")
+	waitFor(t, func() bool {
+		deadLetters, _ := db.GetDeadLetters(queue)
+		return len(deadLetters) == 1
+	}, "Undeliverable event not stored as dead letter")
+	if attempts := receiver.getAttempts(); attempts != 3 {
+		t.Error("Wrong number of attempts", attempts)
+	}
+
+	hd := createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/dead/_hooks/0/deadletters", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Get dead letters: 200 not working")
+	var deadLetters []*Delivery
+	json.Unmarshal(hd.W.(*httptest.ResponseRecorder).Body.Bytes(), &deadLetters)
+	if len(deadLetters) != 1 || deadLetters[0].Attempts != 3 || !strings.Contains(string(deadLetters[0].Payload), `"method":"PUT"`) {
+		t.Fatal("Get dead letters: content not working", hd.W.(*httptest.ResponseRecorder).Body.String())
+	}
+
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/dead/_hooks/0/deadletters/"+deadLetters[0].ID, nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Get dead letter: 200 not working")
+
+	receiver.setStatus(http.StatusOK)
+	hd = createHandlerData(t, db, "POST", "http://localhost:8080/asdf/qwer/dead/_hooks/0/deadletters/"+deadLetters[0].ID, nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Replay dead letter: 200 not working")
+	select {
+	case <-receiver.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Replayed event not delivered")
+	}
+	if deadLetters, _ := db.GetDeadLetters(queue); len(deadLetters) != 0 {
+		t.Error("Replayed dead letter not removed", deadLetters)
+	}
+
+	hd = createHandlerData(t, db, "POST", "http://localhost:8080/asdf/qwer/dead/_hooks/0/deadletters/999", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusNotFound, "Replay inexisting dead letter: 404 not working")
+
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/dead/_hooks/1/deadletters", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusNotFound, "Dead letters of inexisting hook: 404 not working")
+	teardownDB(db)
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// time a queue stays leased beyond the timeout of a post
+const queueLeaseMargin = 30 * time.Second
+
+// the running dispatchers by the database they deliver from
+var dispatchers = struct {
+	sync.Mutex
+	byDB map[GoBusDB][]*dispatcher
+}{byDB: map[GoBusDB][]*dispatcher{}}
+
+// returns the running dispatchers of the database
+func runningDispatchers(db GoBusDB) []*dispatcher {
+	dispatchers.Lock()
+	defer dispatchers.Unlock()
+	return append([]*dispatcher{}, dispatchers.byDB[db]...)
+}
+
+// signals the dispatchers of the database that new deliveries are queued
+func wakeDispatchers(db GoBusDB) {
+	for _, d := range runningDispatchers(db) {
+		d.wake()
+	}
+}
+
+// metrics of the hook delivery as returned by _metrics
+type DeliveryMetrics struct {
+	Workers   int            `json:"workers"`
+	Busy      int            `json:"busy"`      // workers delivering events
+	Backlog   int            `json:"backlog"`   // due hooks waiting for a worker
+	Targets   map[string]int `json:"targets"`   // running posts per target host
+	Delivered int64          `json:"delivered"` // events delivered
+	Failed    int64          `json:"failed"`    // failed attempts
+	Dead      int64          `json:"dead"`      // events given up
+	Pending   int            `json:"pending"`   // events waiting for delivery
+}
+
+// adds the metrics of another dispatcher
+func (m *DeliveryMetrics) add(o DeliveryMetrics) {
+	m.Workers += o.Workers
+	m.Busy += o.Busy
+	m.Backlog += o.Backlog
+	for target, n := range o.Targets {
+		m.Targets[target] += n
+	}
+	m.Delivered += o.Delivered
+	m.Failed += o.Failed
+	m.Dead += o.Dead
+}
+
+// the metrics of a dispatcher
+type dispatcherMetrics struct {
+	mutex   sync.Mutex
+	metrics DeliveryMetrics
+}
+
+func newDispatcherMetrics() *dispatcherMetrics {
+	return &dispatcherMetrics{metrics: DeliveryMetrics{Targets: map[string]int{}}}
+}
+
+// changes the metrics
+func (m *dispatcherMetrics) update(f func(metrics *DeliveryMetrics)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	f(&m.metrics)
+}
+
+// returns a copy of the metrics
+func (m *dispatcherMetrics) snapshot() DeliveryMetrics {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	c := m.metrics
+	c.Targets = map[string]int{}
+	for target, n := range m.metrics.Targets {
+		c.Targets[target] = n
+	}
+	return c
+}
+
+// posts queued events to the hooks with a fixed number of workers
+// the events of a hook are delivered in order by a single worker, a failing event delays the following ones
+// a target host gets at most MaxPerTarget posts at once, further hooks of the target wait until the next dispatch
+type dispatcher struct {
+	db       GoBusDB
+	owner    string // holder of the leases of the queues, keeps other processes from delivering them at the same time
+	cfg      DeliveryConfig
+	client   *http.Client
+	work     chan string // due queues waiting for a worker
+	wakeup   chan bool   // signals that new deliveries are queued
+	metrics  *dispatcherMetrics
+	mutex    sync.Mutex
+	inflight map[string]bool // queues waiting for or being delivered
+	targets  map[string]int  // running posts per target host
+	deferred bool            // set if a queue was skipped because its target was busy
+}
+
+func newDispatcher(db GoBusDB, cfg DeliveryConfig) *dispatcher {
+	owner, err := randomHex(16)
+	if err != nil { // unlikely, the time still tells the processes apart
+		owner = strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return &dispatcher{
+		db:       db,
+		owner:    owner,
+		cfg:      cfg,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		work:     make(chan string, cfg.Workers),
+		wakeup:   make(chan bool, 1),
+		metrics:  newDispatcherMetrics(),
+		inflight: map[string]bool{},
+		targets:  map[string]int{},
+	}
+}
+
+// signals the dispatcher that new deliveries are queued
+func (d *dispatcher) wake() {
+	select {
+	case d.wakeup <- true:
+	default: // already signalled
+	}
+}
+
+// adds the dispatcher to the running dispatchers of its database
+func (d *dispatcher) register() {
+	dispatchers.Lock()
+	defer dispatchers.Unlock()
+	dispatchers.byDB[d.db] = append(dispatchers.byDB[d.db], d)
+}
+
+// removes the dispatcher from the running dispatchers of its database
+func (d *dispatcher) unregister() {
+	dispatchers.Lock()
+	defer dispatchers.Unlock()
+	running := []*dispatcher{}
+	for _, other := range dispatchers.byDB[d.db] {
+		if other != d {
+			running = append(running, other)
+		}
+	}
+	if len(running) == 0 {
+		delete(dispatchers.byDB, d.db)
+	} else {
+		dispatchers.byDB[d.db] = running
+	}
+}
+
+// starts the workers and delivers due events periodically and whenever new events are queued
+// runs until stop is closed, a nil stop runs forever
+func (d *dispatcher) run(interval time.Duration, stop <-chan bool) {
+	d.register()
+	defer d.unregister()
+	for i := 0; i < d.cfg.Workers; i++ {
+		go d.worker(stop)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		d.dispatch()
+		select {
+		case <-ticker.C:
+		case <-d.wakeup:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// delivers the queues handed over by dispatch until stop is closed
+func (d *dispatcher) worker(stop <-chan bool) {
+	d.metrics.update(func(m *DeliveryMetrics) { m.Workers++ })
+	defer d.metrics.update(func(m *DeliveryMetrics) { m.Workers-- })
+	for {
+		select {
+		case queue := <-d.work:
+			d.metrics.update(func(m *DeliveryMetrics) { m.Backlog--; m.Busy++ })
+			d.drain(queue)
+			d.metrics.update(func(m *DeliveryMetrics) { m.Busy-- })
+		case <-stop:
+			return
+		}
+	}
+}
+
+// hands the queues with due events over to the workers
+// if all workers are busy, the remaining queues stay due until the next dispatch
+func (d *dispatcher) dispatch() {
+	queues, err := d.db.DueQueues(time.Now())
+	if err != nil {
+		log.Printf("Internal error, could not get due deliveries: %v", err.Error())
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, queue := range queues {
+		if d.inflight[queue] {
+			continue
+		}
+		d.metrics.update(func(m *DeliveryMetrics) { m.Backlog++ })
+		select {
+		case d.work <- queue:
+			d.inflight[queue] = true
+		default:
+			d.metrics.update(func(m *DeliveryMetrics) { m.Backlog-- })
+			return
+		}
+	}
+}
+
+// returns the host the events are posted to
+func deliveryTarget(deliveryURL string) string {
+	u, err := url.Parse(deliveryURL)
+	if err != nil || u.Host == "" {
+		return deliveryURL
+	}
+	return u.Host
+}
+
+// reserves a post to the target, returns false if the target has too many running posts
+func (d *dispatcher) acquire(target string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.cfg.MaxPerTarget > 0 && d.targets[target] >= d.cfg.MaxPerTarget {
+		d.deferred = true
+		return false
+	}
+	d.targets[target]++
+	d.metrics.update(func(m *DeliveryMetrics) { m.Targets[target]++ })
+	return true
+}
+
+// releases a post to the target, a skipped queue is dispatched again
+func (d *dispatcher) release(target string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.targets[target]--
+	if d.targets[target] == 0 {
+		delete(d.targets, target)
+	}
+	d.metrics.update(func(m *DeliveryMetrics) {
+		m.Targets[target]--
+		if m.Targets[target] <= 0 {
+			delete(m.Targets, target)
+		}
+	})
+	if d.deferred {
+		d.deferred = false
+		d.wake()
+	}
+}
+
+// time a queue stays leased after the lease has been taken or extended, long enough for a post and storing its outcome
+func (d *dispatcher) leaseTTL() time.Duration {
+	return d.cfg.Timeout + queueLeaseMargin
+}
+
+// delivers the events of a queue until it is empty, an event has to be retried later or the target is busy
+// the queue is leased before every post, it is left alone while another process holds the lease
+func (d *dispatcher) drain(queue string) {
+	defer func() {
+		d.mutex.Lock()
+		delete(d.inflight, queue)
+		d.mutex.Unlock()
+	}()
+	defer func() {
+		if err := d.db.ReleaseQueue(queue, d.owner); err != nil {
+			log.Printf("Internal error, could not release %s: %v", queue, err.Error())
+		}
+	}()
+	for {
+		leased, err := d.db.LeaseQueue(queue, d.owner, d.leaseTTL())
+		if err != nil {
+			log.Printf("Internal error, could not lease %s: %v", queue, err.Error())
+			return
+		}
+		if !leased {
+			return
+		}
+		deliveries, err := d.db.GetDeliveries(queue)
+		if err != nil {
+			log.Printf("Internal error, could not get deliveries of %s: %v", queue, err.Error())
+			return
+		}
+		if len(deliveries) == 0 {
+			if _, _, err := queueHook(d.db, queue); err == errHookGone {
+				dropDrainedQueue(d.db, queue)
+			}
+			return
+		}
+		if deliveries[0].NextAttempt.After(time.Now()) && !batchFull(deliveries) {
+			return
+		}
+		batch := nextBatch(deliveries)
+		hook, err := deliveryHook(d.db, queue, deliveries)
+		if err == errHookGone { // nothing left to post the events to, the queue is dropped once drained
+			if !d.giveUp(queue, batch, err) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("Internal error, could not get the hook of %s: %v", queue, err.Error())
+			return
+		}
+		target := deliveryTarget(hook.URL)
+		if !d.acquire(target) {
+			return
+		}
+		next := d.deliver(queue, hook, batch)
+		d.release(target)
+		if !next {
+			return
+		}
+	}
+}
+
+// attempts to deliver an event or a batch of events to the hook, returns true if the next event can be delivered
+// a batch is retried as a whole, its attempts are counted on its first event
+func (d *dispatcher) deliver(queue string, hook *Hook, batch []*Delivery) bool {
+	delivery := batch[0]
+	post, err := newHookPost(hook, batch)
+	if err != nil {
+		log.Printf("Internal error, could not prepare delivery %s: %v", delivery.ID, err.Error())
+		return false
+	}
+	start := time.Now()
+	status, err := d.post(post)
+	attempt := &DeliveryAttempt{
+		Time:       start,
+		DeliveryID: delivery.ID,
+		Event:      post.Payload,
+		Status:     status,
+		Latency:    int64(time.Since(start) / time.Millisecond),
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	if logErr := d.db.LogDeliveryAttempt(queue, attempt); logErr != nil {
+		log.Printf("Internal error, could not log delivery %s: %v", delivery.ID, logErr.Error())
+	}
+	if err == nil {
+		d.metrics.update(func(m *DeliveryMetrics) { m.Delivered += int64(len(batch)) })
+		return d.finish(queue, batch, false)
+	}
+	d.metrics.update(func(m *DeliveryMetrics) { m.Failed++ })
+	defer d.checkHealth(queue)
+	delivery.Attempts++
+	delivery.LastError = err.Error()
+	if delivery.Attempts > d.cfg.Retries {
+		return d.giveUp(queue, batch, err)
+	}
+	delivery.NextAttempt = time.Now().Add(d.cfg.backoff(delivery.Attempts))
+	err = d.db.RetryDelivery(queue, delivery)
+	if err != nil && err != errDeliveryNotFound {
+		log.Printf("Internal error, could not reschedule delivery %s: %v", delivery.ID, err.Error())
+	}
+	return false
+}
+
+// returns the hook the events of a queue are posted to
+// after the deletion of its resource, this is the hook as it was when the resource was deleted
+func deliveryHook(db GoBusDB, queue string, deliveries []*Delivery) (*Hook, error) {
+	_, hook, err := queueHook(db, queue)
+	if err != errHookGone {
+		return hook, err
+	}
+	for _, delivery := range deliveries {
+		if delivery.Hook != nil {
+			return delivery.Hook, nil
+		}
+	}
+	return nil, err
+}
+
+// moves the events of a batch to the dead letters, returns true if the next event can be delivered
+func (d *dispatcher) giveUp(queue string, batch []*Delivery, err error) bool {
+	log.Printf("Giving up delivery %s of %s: %v", batch[0].ID, queue, err.Error())
+	d.metrics.update(func(m *DeliveryMetrics) { m.Dead += int64(len(batch)) })
+	for _, dead := range batch {
+		dead.Attempts = batch[0].Attempts
+		dead.LastError = err.Error()
+	}
+	return d.finish(queue, batch, true)
+}
+
+// removes the delivered or given up events from the head of the queue
+func (d *dispatcher) finish(queue string, batch []*Delivery, dead bool) bool {
+	for _, delivery := range batch {
+		err := d.db.FinishDelivery(queue, delivery, dead)
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// a post of queued events to a hook
+type hookPost struct {
+	URL     string
+	Payload []byte
+	Headers map[string]string
+}
+
+// returns the post of an event or a batch of events to the hook as it is defined now
+// a batch is posted as a JSON array of the events, the static headers and the signature of the hook are added last
+func newHookPost(hook *Hook, batch []*Delivery) (*hookPost, error) {
+	post := &hookPost{URL: hook.URL, Payload: batch[0].Payload, Headers: map[string]string{}}
+	for name, value := range batch[0].Headers {
+		post.Headers[name] = value
+	}
+	if batch[0].Batch > 0 {
+		payloads := make([]json.RawMessage, len(batch))
+		for i, delivery := range batch {
+			payloads[i] = delivery.Payload
+		}
+		data, err := json.Marshal(payloads)
+		if err != nil {
+			return nil, err
+		}
+		post.Payload = data
+		if post.Headers["Content-Type"] == "application/cloudevents+json" {
+			post.Headers["Content-Type"] = "application/cloudevents-batch+json"
+		} else {
+			post.Headers["Content-Type"] = "application/json"
+		}
+	}
+	for name, value := range hook.Headers {
+		post.Headers[http.CanonicalHeaderKey(name)] = value
+	}
+	if hook.Secret != "" {
+		post.Headers[hookSignatureHeader] = signPayload(hook.Secret, post.Payload)
+	}
+	return post, nil
+}
+
+// suspends the hook of the queue if its posts failed too often
+// the events waiting for the suspended hook are moved to its dead letters
+func (d *dispatcher) checkHealth(queue string) {
+	if d.cfg.SuspendAfter == 0 {
+		return
+	}
+	stats, err := d.db.GetDeliveryStats(queue)
+	if err != nil || stats.ConsecutiveFailures < int64(d.cfg.SuspendAfter) {
+		return
+	}
+	res, hook, err := queueHook(d.db, queue)
+	if err != nil || hook.Suspended {
+		return // the hook has been deleted
+	}
+	hook.Suspended = true
+	data, err := json.Marshal(hook)
+	if err == nil {
+		err = res.SetHook(hook.Id, data)
+	}
+	if err != nil {
+		log.Printf("Internal error, could not suspend hook %s: %v", hook.Name, err.Error())
+		return
+	}
+	log.Printf("Suspended hook %s after %d failed posts", hook.Name, stats.ConsecutiveFailures)
+	for {
+		deliveries, err := d.db.GetDeliveries(queue)
+		if err != nil || len(deliveries) == 0 {
+			return
+		}
+		err = d.db.FinishDelivery(queue, deliveries[0], true)
+		if err != nil {
+			log.Printf("Internal error, could not move delivery %s to the dead letters: %v", deliveries[0].ID, err.Error())
+			return
+		}
+	}
+}
+
+// posts the event and returns the status of the response, any status other than 2xx is a failure
+func (d *dispatcher) post(post *hookPost) (int, error) {
+	request, err := http.NewRequest("POST", post.URL, bytes.NewReader(post.Payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range post.Headers {
+		request.Header.Set(name, value)
+	}
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, errors.New(fmt.Sprintf("Hook responded with status %d", response.StatusCode))
+	}
+	return response.StatusCode, nil
+}
+
+// returns the metrics of the hook delivery together with the number of events waiting for delivery
+func handleMetrics(hd *HandlerData) {
+	if hd.R.Method != "GET" {
+		respond(hd, http.StatusMethodNotAllowed, "Method not allowed for metrics.")
+		return
+	}
+	metrics := DeliveryMetrics{Targets: map[string]int{}}
+	for _, d := range runningDispatchers(hd.DB) {
+		metrics.add(d.metrics.snapshot())
+	}
+	queues, err := hd.DB.QueueDepths()
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get queue depths")
+		return
+	}
+	// only the total, the names of the queues tell the hooked resources
+	for _, depth := range queues {
+		metrics.Pending += depth
+	}
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get metrics Json")
+		return
+	}
+	hd.W.Write(data)
+}
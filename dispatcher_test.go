@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeliveryTarget(t *testing.T) {
+	if target := deliveryTarget("http://test.com:8090/a/hook"); target != "test.com:8090" {
+		t.Error("Wrong target", target)
+	}
+	if target := deliveryTarget("no url"); target != "no url" {
+		t.Error("Wrong target of invalid url", target)
+	}
+}
+
+func TestDispatcherLimits(t *testing.T) {
+	db := newTestDB()
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	received := map[string][]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		data, _ := ioutil.ReadAll(r.Body)
+		var event HookEvent
+		json.Unmarshal(data, &event)
+		mutex.Lock()
+		running--
+		received[event.Name] = append(received[event.Name], event.Method)
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	resources := []Resource{}
+	for i := 0; i < 3; i++ {
+		res, _ := db.CreateResource([]string{fmt.Sprintf("limited%d", i)}, true, "", nil, time.Time{})
+		res.AddHook([]byte(fmt.Sprintf(`{"name": "hook%d", "url": "%s"}`, i, server.URL)))
+		resources = append(resources, res)
+	}
+	methods := []string{"PUT", "PATCH", "POST", "DELETE"}
+	for _, method := range methods {
+		for _, res := range resources {
+			callHooks(db, res, method, "/")
+		}
+	}
+
+	cfg := DeliveryConfig{Retries: 2, Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Timeout: time.Second, Workers: 2, MaxPerTarget: 1}
+	stop := make(chan bool)
+	defer close(stop)
+	go newDispatcher(db, cfg).run(10*time.Millisecond, stop)
+
+	waitFor(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(received["hook0"]) == 4 && len(received["hook1"]) == 4 && len(received["hook2"]) == 4
+	}, "Events not delivered")
+	mutex.Lock()
+	defer mutex.Unlock()
+	if maxRunning != 1 {
+		t.Error("Limit per target not respected", maxRunning)
+	}
+	for name, got := range received {
+		for i, method := range methods {
+			if got[i] != method {
+				t.Error("Events not delivered in order", name, got)
+				break
+			}
+		}
+	}
+	teardownDB(db)
+}
+
+func TestHandleMetrics(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"metrics"}, true, "", nil, time.Time{})
+	res.AddHook([]byte(`{"name": "unreachable", "url": "http://test.com/hook"}`))
+	callHooks(db, res, "PUT", "/")
+	callHooks(db, res, "PUT", "/")
+
+	hd := createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/_metrics", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Get metrics: 200 not working")
+	var metrics DeliveryMetrics
+	json.Unmarshal(hd.W.(*httptest.ResponseRecorder).Body.Bytes(), &metrics)
+	if metrics.Pending != 2 || metrics.Workers != 0 {
+		t.Error("Get metrics: queue depth not working", hd.W.(*httptest.ResponseRecorder).Body.String())
+	}
+	if strings.Contains(hd.W.(*httptest.ResponseRecorder).Body.String(), "metrics") {
+		t.Error("Get metrics: hooked resource listed", hd.W.(*httptest.ResponseRecorder).Body.String())
+	}
+
+	// the metrics of the dispatchers of a database are added up
+	other := NewMemoryDB()
+	stop := make(chan bool)
+	defer close(stop)
+	cfg := DeliveryConfig{Retries: 1, Backoff: time.Minute, MaxBackoff: time.Minute, Timeout: time.Second, Workers: 2}
+	go newDispatcher(other, cfg).run(time.Minute, stop)
+	go newDispatcher(other, cfg).run(time.Minute, stop)
+	waitFor(t, func() bool {
+		hd = createHandlerData(t, other, "GET", "http://localhost:8080/asdf/qwer/_metrics", nil)
+		handleRequest(hd)
+		json.Unmarshal(hd.W.(*httptest.ResponseRecorder).Body.Bytes(), &metrics)
+		return metrics.Workers == 4
+	}, "Get metrics: workers of the dispatchers not added up")
+	if len(runningDispatchers(db)) != 0 {
+		t.Error("Dispatchers of another database found")
+	}
+
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/metrics/_metrics", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusNotFound, "Metrics of resource: 404 not working")
+	teardownDB(db)
+}
+
+func TestParseHookQueue(t *testing.T) {
+	elts, id, serial := parseHookQueue(hookQueue([]string{"a", "b"}, "3"))
+	if len(elts) != 2 || elts[1] != "b" || id != "3" || serial != "" {
+		t.Error("Queue not parsed", elts, id, serial)
+	}
+	elts, id, serial = parseHookQueue(hookQueue([]string{}, "0"))
+	if len(elts) != 0 || id != "0" || serial != "" {
+		t.Error("Queue of root not parsed", elts, id, serial)
+	}
+	hook := &Hook{Id: "2", Serial: "ab12"}
+	elts, id, serial = parseHookQueue(hook.queue([]string{"a"}))
+	if len(elts) != 1 || id != "2" || serial != "ab12" {
+		t.Error("Queue with serial not parsed", elts, id, serial)
+	}
+}
+
+func TestHookSuspension(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"suspended"}, true, "", nil, time.Time{})
+	receiver, server := newTestReceiver(http.StatusGone)
+	defer server.Close()
+	res.AddHook([]byte(fmt.Sprintf(`{"name": "failing", "url": "%s"}`, server.URL)))
+	res.AddHook([]byte(`{"name": "expired", "url": "http://test.com/expired", "expires": "2000-01-01T00:00:00Z"}`))
+	queue := hookQueue(res.GetElts(), "0")
+	callHooks(db, res, "PUT", "/")
+	callHooks(db, res, "PUT", "/")
+
+	cfg := DeliveryConfig{Retries: 5, Backoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond, Timeout: time.Second, Workers: 1, SuspendAfter: 3}
+	stop := make(chan bool)
+	defer close(stop)
+	go newDispatcher(db, cfg).run(10*time.Millisecond, stop)
+
+	waitFor(t, func() bool {
+		hook, _ := res.GetHook("0")
+		return hook.Suspended
+	}, "Failing hook not suspended")
+	if attempts := receiver.getAttempts(); attempts != 3 {
+		t.Error("Wrong number of attempts before suspension", attempts)
+	}
+	if deadLetters, _ := db.GetDeadLetters(queue); len(deadLetters) != 2 {
+		t.Error("Pending events not moved to the dead letters", deadLetters)
+	}
+	callHooks(db, res, "PUT", "/")
+	if deliveries, _ := db.GetDeliveries(queue); len(deliveries) != 0 {
+		t.Error("Event queued for suspended hook", deliveries)
+	}
+	if deliveries, _ := db.GetDeliveries(hookQueue(res.GetElts(), "1")); len(deliveries) != 0 {
+		t.Error("Event queued for expired hook", deliveries)
+	}
+
+	var status struct {
+		State               string `json:"state"`
+		ConsecutiveFailures int64  `json:"consecutiveFailures"`
+	}
+	getStatus := func(id string) {
+		hd := createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/suspended/_hooks/"+id, nil)
+		handleRequest(hd)
+		json.Unmarshal(hd.W.(*httptest.ResponseRecorder).Body.Bytes(), &status)
+	}
+	if getStatus("0"); status.State != "suspended" || status.ConsecutiveFailures != 3 {
+		t.Error("Get hook: suspension not shown", status)
+	}
+	if getStatus("1"); status.State != "expired" {
+		t.Error("Get hook: expiry not shown", status)
+	}
+
+	receiver.setStatus(http.StatusOK)
+	data := fmt.Sprintf(`{"name": "failing", "url": "%s"}`, server.URL)
+	hd := createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/suspended/_hooks/0", strings.NewReader(data))
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Reactivate hook: 200 not working")
+	if getStatus("0"); status.State != "active" || status.ConsecutiveFailures != 0 {
+		t.Error("Hook not reactivated", status)
+	}
+	callHooks(db, res, "PUT", "/")
+	select {
+	case <-receiver.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reactivated hook not called")
+	}
+	teardownDB(db)
+}
+
+func TestBatchedDelivery(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"batched"}, true, "", nil, time.Time{})
+	receiver, server := newTestReceiver(http.StatusOK)
+	defer server.Close()
+	res.AddHook([]byte(fmt.Sprintf(`{"name": "full", "url": "%s", "secret": "s", "batchSize": 3, "batchDelay": "1h"}`, server.URL)))
+	stop := startTestDispatcher(db)
+	defer stop()
+
+	for i := 0; i < 4; i++ {
+		callHooks(db, res, "PUT", "/")
+	}
+	var events []HookEvent
+	select {
+	case data := <-receiver.received:
+		if err := json.Unmarshal(data, &events); err != nil || len(events) != 3 || events[0].Method != "PUT" {
+			t.Error("Full batch not posted as array", string(data))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Full batch not delivered")
+	}
+	time.Sleep(50 * time.Millisecond)
+	queue := hookQueue(res.GetElts(), "0")
+	if deliveries, _ := db.GetDeliveries(queue); len(deliveries) != 1 || receiver.getAttempts() != 1 {
+		t.Error("Incomplete batch delivered before its delay", deliveries, receiver.getAttempts())
+	}
+
+	deliveries, _ := db.GetDeliveries(queue)
+	hook, _ := res.GetHook("0")
+	post, err := newHookPost(hook, deliveries)
+	if err != nil || !strings.HasPrefix(string(post.Payload), "[") || post.Headers["Content-Type"] != "application/json" ||
+		post.Headers[hookSignatureHeader] != signPayload("s", post.Payload) {
+		t.Error("Batch not signed", string(post.Payload), post.Headers, err)
+	}
+
+	res, _ = db.CreateResource([]string{"delayed"}, true, "", nil, time.Time{})
+	res.AddHook([]byte(fmt.Sprintf(`{"name": "delayed", "url": "%s", "batchSize": 3, "batchDelay": "200ms"}`, server.URL)))
+	callHooks(db, res, "PUT", "/")
+	callHooks(db, res, "DELETE", "/")
+	select {
+	case data := <-receiver.received:
+		if err := json.Unmarshal(data, &events); err != nil || len(events) != 2 {
+			t.Error("Batch not posted after its delay", string(data))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Batch not delivered after its delay")
+	}
+	teardownDB(db)
+}
+
+func TestDeletedHookQueues(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"dropped"}, true, "", nil, time.Time{})
+	receiver, server := newTestReceiver(http.StatusOK)
+	defer server.Close()
+	res.AddHook([]byte(fmt.Sprintf(`{"name": "dropped", "url": "%s", "serial": "a1"}`, server.URL)))
+	hook, _ := res.GetHook("0")
+	queue := hook.queue(res.GetElts())
+	stop := startTestDispatcher(db)
+	defer stop()
+
+	callHooks(db, res, "PUT", "/")
+	<-receiver.received
+	hd := createHandlerData(t, db, "DELETE", "http://localhost:8080/asdf/qwer/dropped", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Delete resource: 200 not working")
+	select {
+	case <-receiver.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Deletion not delivered")
+	}
+	waitFor(t, func() bool {
+		attempts, _ := db.GetDeliveryLog(queue)
+		stats, _ := db.GetDeliveryStats(queue)
+		return len(attempts) == 0 && stats.Successes == 0
+	}, "Queue of deleted hook not dropped")
+
+	res, _ = db.CreateResource([]string{"dropped"}, true, "", nil, time.Time{})
+	res.AddHook([]byte(fmt.Sprintf(`{"name": "recreated", "url": "%s", "serial": "b2"}`, server.URL)))
+	hook, _ = res.GetHook("0")
+	if stats, _ := db.GetDeliveryStats(hook.queue(res.GetElts())); stats.Successes != 0 {
+		t.Error("Recreated hook inherited the stats", stats)
+	}
+	teardownDB(db)
+}
+
+func TestBatchOfDeletedHook(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"unbatched"}, true, "", nil, time.Time{})
+	res.AddHook([]byte(`{"name": "gone", "url": "http://test.com/gone", "secret": "s", "batchSize": 2, "batchDelay": "1h"}`))
+	queue := hookQueue(res.GetElts(), "0")
+	callHooks(db, res, "PUT", "/")
+	callHooks(db, res, "PUT", "/")
+	res.DeleteHook("0")
+
+	newDispatcher(db, defaultDeliveryConfig()).drain(queue)
+	if deliveries, _ := db.GetDeliveries(queue); len(deliveries) != 0 {
+		t.Error("Batch of deleted hook still queued", deliveries)
+	}
+	if due, _ := db.DueQueues(time.Now().Add(2 * time.Hour)); len(due) != 0 {
+		t.Error("Queue of deleted hook still due", due)
+	}
+	teardownDB(db)
+}
+
+func TestDeliveryFollowsHook(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"moved"}, true, "", nil, time.Time{})
+	failing, oldServer := newTestReceiver(http.StatusInternalServerError)
+	defer oldServer.Close()
+	receiver, server := newTestReceiver(http.StatusOK)
+	defer server.Close()
+	res.AddHook([]byte(fmt.Sprintf(`{"name": "moved", "url": "%s"}`, oldServer.URL)))
+	callHooks(db, res, "PUT", "/")
+	cfg := DeliveryConfig{Retries: 100, Backoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond, Timeout: time.Second, Workers: 1}
+	stop := make(chan bool)
+	defer close(stop)
+	go newDispatcher(db, cfg).run(10*time.Millisecond, stop)
+	waitFor(t, func() bool { return failing.getAttempts() > 0 }, "Event not posted")
+
+	data := fmt.Sprintf(`{"name": "moved", "url": "%s"}`, server.URL)
+	hd := createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/moved/_hooks/0", strings.NewReader(data))
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Move hook: 200 not working")
+	select {
+	case <-receiver.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Queued event not posted to the new URL")
+	}
+	teardownDB(db)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// number of past events kept for clients reconnecting with Last-Event-ID
+const eventBufferSize = 1024
+
+// number of events queued for a slow subscriber before it is disconnected
+const subscriberQueueSize = 64
+
+// interval of comments sent to keep idle event streams open
+const keepAliveInterval = 15 * time.Second
+
+// an event of a resource together with its sequence number
+type brokerEvent struct {
+	ID    int64
+	Event HookEvent
+}
+
+// a client listening to the events of a resource and optionally of its children
+// events is closed when the subscriber falls too far behind
+type subscription struct {
+	path     string
+	children bool
+	events   chan *brokerEvent
+}
+
+// distributes the events of all resources to the subscribers
+// the last events are kept to be replayed to reconnecting clients
+type eventBroker struct {
+	mutex       sync.Mutex
+	nextID      int64
+	recent      []*brokerEvent
+	subscribers map[*subscription]bool
+}
+
+// the broker of this server, every call of hooks is published
+var broker = newEventBroker()
+
+// checks if the subscription is interested in events of the resource at eventPath
+func (s *subscription) matches(eventPath string) bool {
+	return eventPath == s.path || (s.children && path.Dir(eventPath) == s.path)
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		nextID:      1,
+		subscribers: map[*subscription]bool{},
+	}
+}
+
+// publishes an event to all subscribers of the modified resource
+func (b *eventBroker) publish(event HookEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	e := &brokerEvent{b.nextID, event}
+	b.nextID++
+	b.recent = append(b.recent, e)
+	if len(b.recent) > eventBufferSize {
+		b.recent = b.recent[len(b.recent)-eventBufferSize:]
+	}
+	for sub := range b.subscribers {
+		if !sub.matches(event.ModifiedResource) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default: // the client reconnects and gets the missed events replayed
+			delete(b.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// subscribes to the events of the resource at resPath, including its children if children is set
+// returns the buffered events after lastID, lastID < 0 replays nothing
+func (b *eventBroker) subscribe(resPath string, children bool, lastID int64) (*subscription, []*brokerEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	sub := &subscription{resPath, children, make(chan *brokerEvent, subscriberQueueSize)}
+	b.subscribers[sub] = true
+	replay := []*brokerEvent{}
+	if lastID < 0 {
+		return sub, replay
+	}
+	if lastID >= b.nextID { // the server has been restarted
+		lastID = 0
+	}
+	for _, e := range b.recent {
+		if e.ID > lastID && sub.matches(e.Event.ModifiedResource) {
+			replay = append(replay, e)
+		}
+	}
+	return sub, replay
+}
+
+func (b *eventBroker) unsubscribe(sub *subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subscribers[sub] {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// writes a single event in text/event-stream format
+func writeEvent(w http.ResponseWriter, e *brokerEvent, name string) error {
+	event := e.Event
+	event.Name = name
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.ID, data)
+	return err
+}
+
+// streams the events of a resource as server-sent events
+// the optional query parameter name is used as name of the events
+func getEvents(hd *HandlerData, res Resource, cmds []string) {
+	if len(cmds) != 1 {
+		respond(hd, http.StatusNotFound, "Not Found")
+		return
+	}
+	flusher, ok := hd.W.(http.Flusher)
+	if !ok {
+		respond(hd, http.StatusInternalServerError, "Streaming not supported.")
+		return
+	}
+	lastID := int64(-1)
+	if header := hd.R.Header.Get("Last-Event-ID"); header != "" {
+		id, err := strconv.ParseInt(header, 10, 64)
+		if err != nil || id < 0 {
+			respond(hd, http.StatusBadRequest, "Invalid Last-Event-ID")
+			return
+		}
+		lastID = id
+	}
+	name := hd.R.URL.Query().Get("name")
+	sub, replay := broker.subscribe(resourcePath(res, hd.BaseURL.Path), false, lastID)
+	defer broker.unsubscribe(sub)
+
+	w := hd.W
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range replay {
+		if writeEvent(w, e, name) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if writeEvent(w, e, name) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-hd.R.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// handles requests for the _events command
+func handleEventsRequest(hd *HandlerData, res Resource, cmds []string) {
+	switch hd.R.Method {
+	case "GET":
+		getEvents(hd, res, cmds)
+	default:
+		respond(hd, http.StatusMethodNotAllowed, "Method not allowed for events.")
+	}
+}
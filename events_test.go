@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBroker(t *testing.T) {
+	b := newEventBroker()
+	sub, replay := b.subscribe("/a", false, -1)
+	if len(replay) != 0 {
+		t.Error("Events replayed without Last-Event-ID")
+	}
+	b.publish(HookEvent{Method: "PUT", ModifiedResource: "/a"})
+	b.publish(HookEvent{Method: "PUT", ModifiedResource: "/b"})
+	b.publish(HookEvent{Method: "DELETE", ModifiedResource: "/a"})
+	if e := <-sub.events; e.ID != 1 || e.Event.Method != "PUT" {
+		t.Error("First event not received", e)
+	}
+	if e := <-sub.events; e.ID != 3 || e.Event.Method != "DELETE" {
+		t.Error("Event of other resource received", e)
+	}
+	b.unsubscribe(sub)
+
+	// reconnect after the first event
+	sub, replay = b.subscribe("/a", false, 1)
+	if len(replay) != 1 || replay[0].ID != 3 {
+		t.Error("Missed events not replayed", replay)
+	}
+
+	// slow subscribers are disconnected
+	for i := 0; i <= subscriberQueueSize; i++ {
+		b.publish(HookEvent{Method: "PUT", ModifiedResource: "/a"})
+	}
+	for range sub.events {
+	}
+	b.unsubscribe(sub)
+}
+
+// reads the next data line of an event stream
+func readEvent(t *testing.T, reader *bufio.Reader) (string, HookEvent) {
+	var id string
+	var event HookEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal("Event stream closed", err)
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "id: ") {
+			id = line[4:]
+		}
+		if strings.HasPrefix(line, "data: ") {
+			json.Unmarshal([]byte(line[6:]), &event)
+			return id, event
+		}
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"events", "item"}, true, "", nil, time.Time{})
+	baseURL, _ := url.Parse("http://localhost:8080/asdf/qwer/")
+	server := httptest.NewServer(getHandler(db, baseURL, false))
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL+"/asdf/qwer/events/item/_events?name=listener", nil)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal("Could not connect to events", err)
+	}
+	if response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Error("Wrong content type", response.Header.Get("Content-Type"))
+	}
+	callHooks(db, res, "PUT", "/asdf/qwer/")
+	reader := bufio.NewReader(response.Body)
+	id, event := readEvent(t, reader)
+	if event.Name != "listener" || event.Method != "PUT" || !event.Item || event.ModifiedResource != "/asdf/qwer/events/item" {
+		t.Error("Wrong event", event)
+	}
+	response.Body.Close()
+
+	// events during the disconnect are replayed
+	callHooks(db, res, "DELETE", "/asdf/qwer/")
+	request, _ = http.NewRequest("GET", server.URL+"/asdf/qwer/events/item/_events", nil)
+	request.Header.Set("Last-Event-ID", id)
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal("Could not reconnect to events", err)
+	}
+	defer response.Body.Close()
+	done := make(chan HookEvent)
+	go func() {
+		_, event := readEvent(t, bufio.NewReader(response.Body))
+		done <- event
+	}()
+	select {
+	case event = <-done:
+		if event.Method != "DELETE" {
+			t.Error("Wrong replayed event", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Missed event not replayed")
+	}
+	teardownDB(db)
+}
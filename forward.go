@@ -100,6 +100,8 @@ func deleteForward(hd *HandlerData, res Resource, cmds []string) {
 		return
 	}
 	respond(hd, http.StatusOK, "Forward Deleted")
+
+	callCommandHooks(hd.DB, res, "DELETE", "_forward", hd.BaseURL.Path)
 }
 
 // returns the forward if it exists
@@ -140,6 +142,8 @@ func putForward(hd *HandlerData, res Resource, cmds []string) {
 		return
 	}
 	respond(hd, http.StatusOK, "Forward put.")
+
+	callCommandHooks(hd.DB, res, "PUT", "_forward", hd.BaseURL.Path)
 }
 
 // handles requests for the _forward command
@@ -8,13 +8,14 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestAddForward(t *testing.T) {
-	db := NewRedisDB()
+	db := newTestDB()
 
 	resPath := []string{"an_item"}
-	res, _ := db.CreateResource(resPath, false)
+	res, _ := db.CreateResource(resPath, false, "", nil, time.Time{})
 	cmds := []string{"_forward"}
 	data := strings.NewReader(`{"url": "http://blup.com/a/hook"}`)
 	hd := createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/an_item/_forward", data)
@@ -27,14 +28,14 @@ func TestAddForward(t *testing.T) {
 		t.Error("AddForward: Content not working")
 	}
 
-	teardownRedis(db)
+	teardownDB(db)
 }
 
 func TestGetForward(t *testing.T) {
-	db := NewRedisDB()
+	db := newTestDB()
 
 	resPath := []string{"an_item"}
-	res, _ := db.CreateResource(resPath, false)
+	res, _ := db.CreateResource(resPath, false, "", nil, time.Time{})
 	data := []byte(`{"url": "http://blup.com/a/hook"}`)
 	res.AddForward(data)
 
@@ -48,14 +49,14 @@ func TestGetForward(t *testing.T) {
 		t.Error("GetForward: Content not working")
 	}
 
-	teardownRedis(db)
+	teardownDB(db)
 }
 
 func TestDeleteForward(t *testing.T) {
-	db := NewRedisDB()
+	db := newTestDB()
 
 	resPath := []string{"an_item"}
-	res, _ := db.CreateResource(resPath, false)
+	res, _ := db.CreateResource(resPath, false, "", nil, time.Time{})
 	data := []byte(`{"url": "http://blup.com/a/hook"}`)
 	res.AddForward(data)
 
@@ -70,13 +71,13 @@ func TestDeleteForward(t *testing.T) {
 		t.Error("DeleteForward: Content not working")
 	}
 
-	teardownRedis(db)
+	teardownDB(db)
 }
 
 func TestHandleForwarding(t *testing.T) {
-	db := NewRedisDB()
+	db := newTestDB()
 	resPath := []string{"an_item"}
-	res, _ := db.CreateResource(resPath, false)
+	res, _ := db.CreateResource(resPath, false, "", nil, time.Time{})
 
 	// start server for forwarding test
 	c := make(chan []byte, 256)
@@ -104,5 +105,5 @@ func TestHandleForwarding(t *testing.T) {
 	if bytes.Compare([]byte(postdata), receivedData) != 0 {
 		t.Error("Data wrong")
 	}
-	teardownRedis(db)
+	teardownDB(db)
 }
@@ -0,0 +1,14 @@
+module github.com/imix/gobus
+
+go 1.22
+
+require (
+	github.com/gorilla/websocket v1.5.0
+	go.etcd.io/bbolt v1.3.11
+	gopkg.in/redis.v3 v3.6.4
+)
+
+require (
+	golang.org/x/sys v0.4.0 // indirect
+	gopkg.in/bsm/ratelimit.v1 v1.0.0-20160220154919-db14e161995a // indirect
+)
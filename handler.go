@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -14,10 +15,11 @@ import (
 )
 
 type HandlerData struct {
-	DB      GoBusDB
-	BaseURL *url.URL
-	W       http.ResponseWriter
-	R       *http.Request
+	DB             GoBusDB
+	BaseURL        *url.URL // public URL gobus is mounted at
+	TrustForwarded bool     // use X-Forwarded-Proto and X-Forwarded-Host for public URLs
+	W              http.ResponseWriter
+	R              *http.Request
 }
 
 // creates a standard response
@@ -29,16 +31,38 @@ func respond(hd *HandlerData, status int, msg string) {
 	fmt.Fprintf(w, "Request URL: %s\n", r.URL.String())
 }
 
-// respond with a "Created" (201) and set location to the new url
-// the new url is composed of the path with id attached
-func respondCreatedNewURL(w http.ResponseWriter, baseUrl *url.URL, id string) {
-	newURL := url.URL{
-		Scheme: baseUrl.Scheme,
-		Host:   baseUrl.Host,
-		Path:   path.Join(baseUrl.Path, id),
+// returns the public URL of the given path
+// scheme and host are taken from the base URL or the forwarded headers if trusted
+func publicURL(hd *HandlerData, urlPath string) *url.URL {
+	publicURL := &url.URL{
+		Scheme: hd.BaseURL.Scheme,
+		Host:   hd.BaseURL.Host,
+		Path:   urlPath,
 	}
-	w.WriteHeader(http.StatusCreated)
+	if hd.TrustForwarded {
+		if proto := forwardedHeader(hd.R, "X-Forwarded-Proto"); proto != "" {
+			publicURL.Scheme = proto
+		}
+		if host := forwardedHeader(hd.R, "X-Forwarded-Host"); host != "" {
+			publicURL.Host = host
+		}
+	}
+	return publicURL
+}
+
+// returns the value set by the first proxy in a forwarded header
+func forwardedHeader(r *http.Request, name string) string {
+	values := strings.Split(r.Header.Get(name), ",")
+	return strings.TrimSpace(values[0])
+}
+
+// respond with a "Created" (201) and set location to the new url
+// the new url is composed of the request path with id attached
+func respondCreatedNewURL(hd *HandlerData, id string) {
+	newURL := publicURL(hd, path.Join(hd.R.URL.Path, id))
+	w := hd.W
 	w.Header().Set("Location", newURL.String())
+	w.WriteHeader(http.StatusCreated)
 	fmt.Fprintf(w, "201 Resource Created %s!", newURL.String())
 }
 
@@ -51,19 +75,37 @@ func postCollection(hd *HandlerData, res Resource) {
 		respond(hd, http.StatusBadRequest, "Invalid Request")
 		return
 	}
+	expires, err := requestExpiry(hd)
+	if err != nil {
+		respond(hd, http.StatusBadRequest, err.Error())
+		return
+	}
 	contentType := hd.R.Header.Get("Content-Type")
-	name, err := res.AddToCollection(contentType, data)
+	name, err := res.AddToCollection(contentType, data, expires)
 	if err != nil {
-		log.Printf("Internal error, could not get hooks: ", err.Error())
+		log.Printf("Internal error, could not add to collection: %v", err.Error())
+		respond(hd, http.StatusInternalServerError, "Could not add to collection.")
 		return
 	}
-	respondCreatedNewURL(hd.W, hd.R.URL, name)
+	respondCreatedNewURL(hd, name)
 
-	callHooks(res, "POST", hd.BaseURL.Path)
+	callHooks(hd.DB, res, "POST", hd.BaseURL.Path)
 }
 
 // gets a collection, returns a list of children in the collection
 func getCollection(hd *HandlerData, res Resource) {
+	if !awaitChange(hd, res) {
+		return
+	}
+	// read the version first, a concurrent change then leads to an outdated ETag
+	version, err := res.Version()
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get version")
+		return
+	}
+	if notModified(hd, version) {
+		return
+	}
 	abs_ids, err := res.GetChildren()
 	if err != nil {
 		respond(hd, http.StatusInternalServerError, "Could not get children")
@@ -80,6 +122,7 @@ func getCollection(hd *HandlerData, res Resource) {
 		respond(hd, http.StatusInternalServerError, "Could not get Collection Json")
 		return
 	}
+	hd.W.Header().Set("ETag", etag(version))
 	hd.W.Write(json)
 }
 
@@ -106,40 +149,94 @@ func putItem(hd *HandlerData, res Resource) {
 		respond(hd, http.StatusBadRequest, "Invalid Request")
 		return
 	}
+	expires, err := requestExpiry(hd)
+	if err != nil {
+		respond(hd, http.StatusBadRequest, err.Error())
+		return
+	}
+	version, ok := checkPreconditions(hd, res)
+	if !ok {
+		return
+	}
+	oldType, old, err := res.GetValue()
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get item value.")
+		return
+	}
 	contentType := hd.R.Header.Get("Content-Type")
-	err = res.SetValue(contentType, data)
+	newVersion, err := res.SetValueIfVersion(contentType, data, version, expires)
+	if err == errVersionMismatch {
+		respond(hd, http.StatusPreconditionFailed, "Resource has been modified.")
+		return
+	}
 	if err != nil {
 		respond(hd, http.StatusInternalServerError, "Could not set item value.")
 		return
 	}
+	hd.W.Header().Set("ETag", etag(newVersion))
 	respond(hd, http.StatusOK, fmt.Sprintf("Put %s!", data))
 
-	callHooks(res, "PUT", hd.BaseURL.Path)
+	callItemHooks(hd.DB, res, "PUT", hd.BaseURL.Path, oldType, old, contentType, data)
 }
 
 func getItem(hd *HandlerData, res Resource) {
+	if !awaitChange(hd, res) {
+		return
+	}
+	// read the version first, a concurrent change then leads to an outdated ETag
+	version, err := res.Version()
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get version.")
+		return
+	}
+	if notModified(hd, version) {
+		return
+	}
 	ct, value, err := res.GetValue()
 	if err != nil {
 		respond(hd, http.StatusInternalServerError, "Could not get item value.")
 		return
 	}
+	expires, err := res.GetExpiry()
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get item TTL.")
+		return
+	}
 	w := hd.W
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", ct)
+	w.Header().Set("ETag", etag(version))
+	if !expires.IsZero() {
+		w.Header().Set(ttlHeader, strconv.FormatInt(remainingTTL(expires), 10))
+	}
+	w.WriteHeader(http.StatusOK)
 	w.Write(value)
 }
 
 // deletes an resource (item or collection)
 func deleteResource(hd *HandlerData, res Resource) {
-	// call Hooks before executing delete
-	callHooks(res, "DELETE", hd.BaseURL.Path)
+	version, ok := checkPreconditions(hd, res)
+	if !ok {
+		return
+	}
+	// collect the hooks before executing delete, they are deleted with the resource
+	call, err := newHookCall(hd.DB, res, "DELETE", hd.BaseURL.Path)
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get hooks.")
+		return
+	}
 
-	err := res.Delete()
+	err = res.DeleteIfVersion(version)
+	if err == errVersionMismatch {
+		respond(hd, http.StatusPreconditionFailed, "Resource has been modified.")
+		return
+	}
 	if err != nil {
 		respond(hd, http.StatusNotFound, "Could not delete Item")
 		return
 	}
 	respond(hd, http.StatusOK, fmt.Sprintf("Item deleted!"))
+
+	call.sendDeleted(hd.DB, res.GetElts())
 }
 
 // handles methods on items
@@ -151,6 +248,8 @@ func handleItem(hd *HandlerData, res Resource) {
 		getItem(hd, res)
 	case "PUT":
 		putItem(hd, res)
+	case "PATCH":
+		patchItem(hd, res)
 	default:
 		respond(hd, http.StatusMethodNotAllowed, "Method not allowed for items.")
 	}
@@ -178,6 +277,9 @@ func handleInexistingResource(hd *HandlerData, comps []string) {
 		respond(hd, http.StatusNotFound, "Resource not found.")
 		return
 	}
+	if !checkInexistingPreconditions(hd) {
+		return
+	}
 	body := hd.R.Body
 	data, err := ioutil.ReadAll(body)
 	body.Close()
@@ -185,18 +287,38 @@ func handleInexistingResource(hd *HandlerData, comps []string) {
 		respond(hd, http.StatusBadRequest, "Invalid Request")
 		return
 	}
-	res, err := hd.DB.CreateResource(comps, len(data) > 0)
+	expires, err := requestExpiry(hd)
 	if err != nil {
+		respond(hd, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(data) == 0 && !expires.IsZero() {
+		respond(hd, http.StatusBadRequest, "Only items can expire.")
+		return
+	}
+	contentType := hd.R.Header.Get("Content-Type")
+	res, err := hd.DB.CreateResource(comps, len(data) > 0, contentType, data, expires)
+	if err == errResourceExists {
+		// created concurrently, handle the request as a PUT on the existing resource
+		res, err = hd.DB.GetResource(comps)
+		if err == nil {
+			hd.R.Body = ioutil.NopCloser(bytes.NewReader(data))
+			handleExistingResource(hd, res)
+			return
+		}
+	}
+	if err != nil {
+		log.Printf("Internal error, could not create resource: %v", err.Error())
 		respond(hd, http.StatusInternalServerError, "Could not create Resource")
 		return
 	}
 	msg := "Resource created"
-	if len(data) > 0 { // add value to item
-		contentType := hd.R.Header.Get("Content-Type")
-		res.SetValue(contentType, data)
+	if len(data) > 0 {
 		msg = fmt.Sprintf("Put %s!", data)
 	}
 	respond(hd, http.StatusCreated, msg)
+
+	callCreateHooks(hd.DB, res, hd.BaseURL.Path, contentType, data)
 }
 
 // handles any type of command in a request
@@ -206,8 +328,14 @@ func handleCommand(hd *HandlerData, res Resource, cmds []string) {
 		handleHookRequest(hd, res, cmds)
 	case "_forward":
 		handleForwardRequest(hd, res, cmds)
+	case "_ttl":
+		handleTTLRequest(hd, res, cmds)
+	case "_history":
+		handleHistoryRequest(hd, res, cmds)
+	case "_events":
+		handleEventsRequest(hd, res, cmds)
 	default:
-		log.Printf("unimplemented command", cmds)
+		log.Printf("unimplemented command %v", cmds)
 		respond(hd, http.StatusNotFound, "Not Found")
 	}
 }
@@ -223,6 +351,14 @@ func handleRequest(hd *HandlerData) {
 	/*if accessAllowed() {
 	respond
 	*/
+	if len(comps) == 0 && len(cmds) == 1 && cmds[0] == "_ws" {
+		handleWebSocket(hd)
+		return
+	}
+	if len(comps) == 0 && len(cmds) == 1 && cmds[0] == "_metrics" {
+		handleMetrics(hd)
+		return
+	}
 	res, err := getForwardResource(hd, comps, cmds)
 	if err != nil {
 		respond(hd, http.StatusInternalServerError, "Could not get ForwardResource")
@@ -237,6 +373,20 @@ func handleRequest(hd *HandlerData) {
 		respond(hd, http.StatusInternalServerError, "Could not get Resource")
 		return
 	}
+	if exists {
+		res, err = hd.DB.GetResource(comps)
+		if err != nil {
+			respond(hd, http.StatusInternalServerError, "Resource Not Found")
+			return
+		}
+		// expired items which have not been removed yet do not exist anymore
+		expired, err := expireIfDue(hd.DB, res, hd.BaseURL.Path)
+		if err != nil {
+			respond(hd, http.StatusInternalServerError, "Could not expire Resource")
+			return
+		}
+		exists = !expired
+	}
 	if !exists {
 		if len(cmds) == 0 {
 			handleInexistingResource(hd, comps)
@@ -245,11 +395,6 @@ func handleRequest(hd *HandlerData) {
 		}
 		return
 	}
-	res, err = hd.DB.GetResource(comps)
-	if err != nil {
-		respond(hd, http.StatusInternalServerError, "Resource Not Found")
-		return
-	}
 	if len(cmds) > 0 {
 		handleCommand(hd, res, cmds)
 		return
@@ -258,13 +403,15 @@ func handleRequest(hd *HandlerData) {
 }
 
 // creates a http handler for handling requests
-func getHandler(db GoBusDB, baseURL *url.URL) http.HandlerFunc {
+// baseURL is the public URL gobus is reachable at, its path is the prefix of all resources
+func getHandler(db GoBusDB, baseURL *url.URL, trustForwarded bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		hd := &HandlerData{
-			DB:      db,
-			BaseURL: baseURL,
-			W:       w,
-			R:       r,
+			DB:             db,
+			BaseURL:        baseURL,
+			TrustForwarded: trustForwarded,
+			W:              w,
+			R:              r,
 		}
 		start := time.Now()
 
@@ -6,14 +6,37 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func teardownRedis(db GoBusDB) {
 	db.(*RedisDB).Client.FlushDb()
 }
 
+// returns the db the handler tests run on
+// set GOBUS_TEST_BACKEND to run them against another backend (e.g. redis)
+func newTestDB() GoBusDB {
+	backend := os.Getenv("GOBUS_TEST_BACKEND")
+	if backend == "" {
+		backend = "memory"
+	}
+	db, err := NewDB(DBConfig{Backend: backend})
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// cleans up after a test using newTestDB
+func teardownDB(db GoBusDB) {
+	if _, ok := db.(*RedisDB); ok {
+		teardownRedis(db)
+	}
+}
+
 //XXX test nested collections
 
 // create HandlerDate for the Tests
@@ -41,7 +64,7 @@ func checkCode(t *testing.T, hd *HandlerData, code int, msg string) {
 }
 
 func TestRespond(t *testing.T) {
-	db := NewRedisDB()
+	db := newTestDB()
 	hd := createHandlerData(t, db, "GET", "http://example.com/foo", nil)
 	w := hd.W.(*httptest.ResponseRecorder)
 	respond(hd, http.StatusNotFound, "a message")
@@ -52,13 +75,59 @@ func TestRespond(t *testing.T) {
 	if !strings.Contains(w.Body.String(), "a message") {
 		t.Error("Body not set msg")
 	}
-	teardownRedis(db)
+	teardownDB(db)
+}
+
+func TestPublicURL(t *testing.T) {
+	db := newTestDB()
+	hd := createHandlerData(t, db, "POST", "http://internal:9000/asdf/qwer/coll", nil)
+	hd.R.Header.Set("X-Forwarded-Proto", "https")
+	hd.R.Header.Set("X-Forwarded-Host", "bus.example.com, proxy.internal")
+
+	if u := publicURL(hd, "/asdf/qwer/coll"); u.String() != "http://localhost:8080/asdf/qwer/coll" {
+		t.Error("Base URL not used", u)
+	}
+	hd.TrustForwarded = true
+	if u := publicURL(hd, "/asdf/qwer/coll"); u.String() != "https://bus.example.com/asdf/qwer/coll" {
+		t.Error("Forwarded headers not used", u)
+	}
+	respondCreatedNewURL(hd, "0")
+	checkCode(t, hd, http.StatusCreated, "Created: 201 not working")
+	if hd.W.Header().Get("Location") != "https://bus.example.com/asdf/qwer/coll/0" {
+		t.Error("Location wrong", hd.W.Header().Get("Location"))
+	}
+	teardownDB(db)
+}
+
+func TestHandlerSubPath(t *testing.T) {
+	db := newTestDB()
+	baseURL, _ := url.Parse("https://bus.example.com/gobus/")
+	handler := getHandler(db, baseURL, false)
+	db.CreateResource([]string{"coll"}, false, "", nil, time.Time{})
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://localhost:8080/gobus/coll", strings.NewReader("data"))
+	handler(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatal("Post below sub-path failed", w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "https://bus.example.com/gobus/coll/0" {
+		t.Error("Location wrong", location)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://localhost:8080/coll", nil)
+	handler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Error("Request outside of sub-path accepted", w.Code)
+	}
+	teardownDB(db)
 }
 
 func TestHandlePut(t *testing.T) {
-	db := NewRedisDB()
+	db := newTestDB()
 	resPath := []string{"path", "res"}
-	res, _ := db.CreateResource(resPath, true)
+	res, _ := db.CreateResource(resPath, true, "", nil, time.Time{})
 
 	// put to item
 	data := strings.NewReader("some data àL")
@@ -72,7 +141,7 @@ func TestHandlePut(t *testing.T) {
 	}
 	// put to collection
 	resPath = []string{"a", "collection"}
-	res, _ = db.CreateResource(resPath, false)
+	res, _ = db.CreateResource(resPath, false, "", nil, time.Time{})
 
 	data = strings.NewReader("some data")
 	hd = createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/a/collection", data)
@@ -83,13 +152,37 @@ func TestHandlePut(t *testing.T) {
 	hd = createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/new/item", data)
 	handleRequest(hd)
 	checkCode(t, hd, http.StatusCreated, "Put: 201 not working")
-	teardownRedis(db)
+	teardownDB(db)
+}
+
+func TestHandlePutCreatedConcurrently(t *testing.T) {
+	db := newTestDB()
+	resPath := []string{"new", "item"}
+	db.CreateResource(resPath, true, "text/plain", []byte("first"), time.Time{})
+
+	// the resource has been created after the request found it missing
+	hd := createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/new/item", strings.NewReader("second"))
+	handleInexistingResource(hd, resPath)
+	checkCode(t, hd, http.StatusOK, "Put: not handled as put on the existing item")
+	res, _ := db.GetResource(resPath)
+	if _, value, _ := res.GetValue(); string(value) != "second" {
+		t.Error("Put: Value not set", string(value))
+	}
+
+	hd = createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/new/item", strings.NewReader("third"))
+	hd.R.Header.Set("If-None-Match", "*")
+	handleInexistingResource(hd, resPath)
+	checkCode(t, hd, http.StatusPreconditionFailed, "Put: If-None-Match not checked on the existing item")
+	if _, value, _ := res.GetValue(); string(value) != "second" {
+		t.Error("Put: Value overwritten", string(value))
+	}
+	teardownDB(db)
 }
 
 func TestHandlePost(t *testing.T) {
-	db := NewRedisDB()
+	db := newTestDB()
 	resPath := []string{"path", "res"}
-	db.CreateResource(resPath, false)
+	db.CreateResource(resPath, false, "", nil, time.Time{})
 
 	// post to existing collection
 	data := strings.NewReader("some data")
@@ -115,18 +208,18 @@ func TestHandlePost(t *testing.T) {
 
 	// post to item
 	resPath = []string{"an", "item"}
-	db.CreateResource(resPath, true)
+	db.CreateResource(resPath, true, "", nil, time.Time{})
 
 	hd = createHandlerData(t, db, "POST", "http://localhost:8080/asdf/qwer/an/item", data)
 	handleRequest(hd)
 	checkCode(t, hd, http.StatusMethodNotAllowed, "Post: 405 not working")
-	teardownRedis(db)
+	teardownDB(db)
 }
 
 func TestHandleDelete(t *testing.T) {
-	db := NewRedisDB()
+	db := newTestDB()
 	resPath := []string{"path", "res"}
-	db.CreateResource(resPath, true)
+	db.CreateResource(resPath, true, "", nil, time.Time{})
 
 	// delete intermediate resource
 	hd := createHandlerData(t, db, "DELETE", "http://localhost:8080/asdf/qwer/path", nil)
@@ -146,13 +239,13 @@ func TestHandleDelete(t *testing.T) {
 	hd = createHandlerData(t, db, "DELETE", "http://localhost:8080/asdf/qwer/asdfas/res", nil)
 	handleRequest(hd)
 	checkCode(t, hd, http.StatusNotFound, "Delete inexisting: 404 not working")
-	teardownRedis(db)
+	teardownDB(db)
 }
 
 func TestHandleDeleteCommands(t *testing.T) {
-	db := NewRedisDB()
+	db := newTestDB()
 	resPath := []string{"path", "res"}
-	res, _ := db.CreateResource(resPath, true)
+	res, _ := db.CreateResource(resPath, true, "", nil, time.Time{})
 	hookData := []byte(fmt.Sprintf(`{"name": "a_hook", "url": "http://test.com/a/hook"}`))
 	res.AddHook(hookData)
 
@@ -174,13 +267,13 @@ func TestHandleDeleteCommands(t *testing.T) {
 	if len(hooks) > 0 {
 		t.Error("Delete Hook not working")
 	}
-	teardownRedis(db)
+	teardownDB(db)
 }
 
 func TestHandleGet(t *testing.T) {
-	db := NewRedisDB()
+	db := newTestDB()
 	resPath := []string{"path", "res"}
-	res, _ := db.CreateResource(resPath, true)
+	res, _ := db.CreateResource(resPath, true, "", nil, time.Time{})
 
 	// request an existing resource
 	hd := createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/path/res", nil)
@@ -198,13 +291,13 @@ func TestHandleGet(t *testing.T) {
 	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/asdfas/res", nil)
 	handleRequest(hd)
 	checkCode(t, hd, http.StatusNotFound, "Get: 404 not working")
-	teardownRedis(db)
+	teardownDB(db)
 }
 
 func TestHandleGetCollection(t *testing.T) {
-	db := NewRedisDB()
+	db := newTestDB()
 	resPath := []string{"path", "res"}
-	db.CreateResource(resPath, false)
+	db.CreateResource(resPath, false, "", nil, time.Time{})
 	hd := createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/path/res", nil)
 	handleRequest(hd)
 	if !strings.Contains(hd.W.(*httptest.ResponseRecorder).Body.String(), "[]") {
@@ -220,5 +313,82 @@ func TestHandleGetCollection(t *testing.T) {
 		t.Error("Get: content not set")
 	}
 
-	teardownRedis(db)
+	teardownDB(db)
+}
+
+func TestHandleConditional(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"path", "res"}, true, "", nil, time.Time{})
+	res.SetValue("text", []byte("blup"))
+	version, _ := res.Version()
+	current := etag(version)
+
+	// get returns the etag, if-none-match returns 304
+	hd := createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/path/res", nil)
+	handleRequest(hd)
+	if hd.W.Header().Get("ETag") != current {
+		t.Error("Get: ETag not set", hd.W.Header().Get("ETag"))
+	}
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/path/res", nil)
+	hd.R.Header.Set("If-None-Match", current)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusNotModified, "Get: 304 not working")
+
+	// put with outdated etag fails
+	hd = createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/path/res", strings.NewReader("new"))
+	hd.R.Header.Set("If-Match", `"99"`)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusPreconditionFailed, "Put: 412 not working")
+	if _, value, _ := res.GetValue(); string(value) != "blup" {
+		t.Error("Put: value modified despite failed precondition")
+	}
+
+	// if-match compares strongly, a weak etag never matches
+	hd = createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/path/res", strings.NewReader("new"))
+	hd.R.Header.Set("If-Match", "W/"+current)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusPreconditionFailed, "Put: weak If-Match 412 not working")
+
+	// put with current etag succeeds
+	hd = createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/path/res", strings.NewReader("new"))
+	hd.R.Header.Set("If-Match", current)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Put: 200 not working")
+	if hd.W.Header().Get("ETag") == current {
+		t.Error("Put: ETag not updated")
+	}
+
+	// put with if-none-match * on an existing resource fails
+	hd = createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/path/res", strings.NewReader("new"))
+	hd.R.Header.Set("If-None-Match", "*")
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusPreconditionFailed, "Put: If-None-Match 412 not working")
+
+	// if-match on inexisting resource fails
+	hd = createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/path/new", strings.NewReader("new"))
+	hd.R.Header.Set("If-Match", "*")
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusPreconditionFailed, "Put inexisting: 412 not working")
+
+	// delete with outdated etag fails
+	hd = createHandlerData(t, db, "DELETE", "http://localhost:8080/asdf/qwer/path/res", nil)
+	hd.R.Header.Set("If-Match", current)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusPreconditionFailed, "Delete: 412 not working")
+	if exists, _ := db.ResourceExists([]string{"path", "res"}); !exists {
+		t.Error("Delete: deleted despite failed precondition")
+	}
+
+	// a recreated resource does not accept the etags of the deleted one
+	version, _ = res.Version()
+	res.Delete()
+	time.Sleep(time.Millisecond) // initial versions are based on the creation time in µs
+	res, _ = db.CreateResource([]string{"path", "res"}, true, "", nil, time.Time{})
+	res.SetValue("text", []byte("blup"))
+	res.SetValue("text", []byte("blup"))
+	hd = createHandlerData(t, db, "DELETE", "http://localhost:8080/asdf/qwer/path/res", nil)
+	hd.R.Header.Set("If-Match", etag(version))
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusPreconditionFailed, "Delete recreated: 412 not working")
+	teardownDB(db)
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// a previous value of an item
+type Revision struct {
+	Version     int64     `json:"version"`
+	Time        time.Time `json:"time"`
+	ContentType string    `json:"contentType"`
+	Value       []byte    `json:"value,omitempty"`
+}
+
+// the history of an item as returned by _history
+type History struct {
+	Depth     int         `json:"depth"` // number of revisions kept, 0 if disabled
+	Revisions []*Revision `json:"revisions"`
+}
+
+var errRevisionNotFound = errors.New("Revision not found")
+
+// returns the revision of the given version from a list of revisions
+func findRevision(revisions []*Revision, version int64) (*Revision, error) {
+	for _, revision := range revisions {
+		if revision.Version == version {
+			return revision, nil
+		}
+	}
+	return nil, errRevisionNotFound
+}
+
+// returns the revision addressed by cmds (_history/<version>)
+// sends an error response and returns nil if it can not be found
+func requestRevision(hd *HandlerData, res Resource, cmds []string) *Revision {
+	version, err := strconv.ParseInt(cmds[1], 10, 64)
+	if err != nil {
+		respond(hd, http.StatusNotFound, "Not Found")
+		return nil
+	}
+	revision, err := res.GetRevision(version)
+	if err == errRevisionNotFound {
+		respond(hd, http.StatusNotFound, "Revision not found.")
+		return nil
+	}
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get revision.")
+		return nil
+	}
+	return revision
+}
+
+// history handlers
+// returns the list of revisions without values or the value of a single revision
+func getHistory(hd *HandlerData, res Resource, cmds []string) {
+	switch len(cmds) {
+	case 1:
+		depth, err := res.GetHistoryDepth()
+		if err != nil {
+			respond(hd, http.StatusInternalServerError, "Could not get history depth")
+			return
+		}
+		revisions, err := res.GetHistory()
+		if err != nil {
+			respond(hd, http.StatusInternalServerError, "Could not get history")
+			return
+		}
+		history := History{depth, []*Revision{}}
+		for _, revision := range revisions {
+			history.Revisions = append(history.Revisions, &Revision{revision.Version, revision.Time, revision.ContentType, nil})
+		}
+		data, err := json.Marshal(history)
+		if err != nil {
+			respond(hd, http.StatusInternalServerError, "Could not get history Json")
+			return
+		}
+		hd.W.Write(data)
+	case 2:
+		revision := requestRevision(hd, res, cmds)
+		if revision == nil {
+			return
+		}
+		w := hd.W
+		w.Header().Set("Content-Type", revision.ContentType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(revision.Value)
+	default:
+		respond(hd, http.StatusNotFound, "Not Found")
+	}
+}
+
+// sets the depth of the history, 0 disables it
+func putHistory(hd *HandlerData, res Resource, cmds []string) {
+	if len(cmds) != 1 {
+		respond(hd, http.StatusNotFound, "Not Found")
+		return
+	}
+	body := hd.R.Body
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		respond(hd, http.StatusBadRequest, "Invalid Request")
+		return
+	}
+	var history History
+	err = json.Unmarshal(data, &history)
+	if err != nil || history.Depth < 0 {
+		respond(hd, http.StatusBadRequest, "Invalid history depth")
+		return
+	}
+	err = res.SetHistoryDepth(history.Depth)
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not set history depth")
+		return
+	}
+	respond(hd, http.StatusOK, "History depth set.")
+}
+
+// restores a revision, it becomes the current value of the item
+func restoreRevision(hd *HandlerData, res Resource, cmds []string) {
+	if len(cmds) != 2 {
+		respond(hd, http.StatusMethodNotAllowed, "Method not allowed for history.")
+		return
+	}
+	revision := requestRevision(hd, res, cmds)
+	if revision == nil {
+		return
+	}
+	version, ok := checkPreconditions(hd, res)
+	if !ok {
+		return
+	}
+	oldType, old, err := res.GetValue()
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get item value.")
+		return
+	}
+	newVersion, err := res.SetValueIfVersion(revision.ContentType, revision.Value, version, time.Time{})
+	if err == errVersionMismatch {
+		respond(hd, http.StatusPreconditionFailed, "Resource has been modified.")
+		return
+	}
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not restore revision.")
+		return
+	}
+	hd.W.Header().Set("ETag", etag(newVersion))
+	respond(hd, http.StatusOK, fmt.Sprintf("Restored revision %d!", revision.Version))
+
+	callItemHooks(hd.DB, res, "PUT", hd.BaseURL.Path, oldType, old, revision.ContentType, revision.Value)
+}
+
+// handles requests for the _history command, only items have a history
+func handleHistoryRequest(hd *HandlerData, res Resource, cmds []string) {
+	isitem, err := res.IsItem()
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get Resource type.")
+		return
+	}
+	if !isitem {
+		respond(hd, http.StatusMethodNotAllowed, "Only items have a history.")
+		return
+	}
+	switch hd.R.Method {
+	case "GET":
+		getHistory(hd, res, cmds)
+	case "PUT":
+		putHistory(hd, res, cmds)
+	case "POST":
+		restoreRevision(hd, res, cmds)
+	default:
+		respond(hd, http.StatusMethodNotAllowed, "Method not allowed for history.")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleHistory(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"item"}, true, "", nil, time.Time{})
+	db.CreateResource([]string{"coll"}, false, "", nil, time.Time{})
+
+	hd := createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/item/_history", strings.NewReader(`{"depth": 5}`))
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Put _history: 200 not working")
+
+	first, _ := res.SetValueIfVersion("text/plain", []byte("first"), anyVersion, time.Time{})
+	res.SetValueIfVersion("application/json", []byte(`"second"`), anyVersion, time.Time{})
+
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/item/_history", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Get _history: 200 not working")
+	var history History
+	json.Unmarshal(hd.W.(*httptest.ResponseRecorder).Body.Bytes(), &history)
+	if history.Depth != 5 || len(history.Revisions) != 2 || history.Revisions[1].Version != first {
+		t.Error("Get _history: content not working", hd.W.(*httptest.ResponseRecorder).Body.String())
+	}
+	if history.Revisions[0].Value != nil {
+		t.Error("Get _history: values listed")
+	}
+
+	url := "http://localhost:8080/asdf/qwer/item/_history/" + strconv.FormatInt(first, 10)
+	hd = createHandlerData(t, db, "GET", url, nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Get revision: 200 not working")
+	if hd.W.Header().Get("Content-Type") != "text/plain" || hd.W.(*httptest.ResponseRecorder).Body.String() != "first" {
+		t.Error("Get revision: content not working", hd.W.(*httptest.ResponseRecorder).Body.String())
+	}
+
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/item/_history/999", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusNotFound, "Get inexisting revision: 404 not working")
+
+	// restore with an outdated version fails
+	hd = createHandlerData(t, db, "POST", url, nil)
+	hd.R.Header.Set("If-Match", etag(first))
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusPreconditionFailed, "Restore revision: 412 not working")
+
+	hd = createHandlerData(t, db, "POST", url, nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Restore revision: 200 not working")
+	ct, value, _ := res.GetValue()
+	if ct != "text/plain" || string(value) != "first" {
+		t.Error("Restore revision: value not restored", ct, string(value))
+	}
+	if version, _ := res.Version(); hd.W.Header().Get("ETag") != etag(version) {
+		t.Error("Restore revision: ETag not set", hd.W.Header().Get("ETag"))
+	}
+	if revisions, _ := res.GetHistory(); len(revisions) != 3 {
+		t.Error("Restore revision: restore not in history", len(revisions))
+	}
+
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/coll/_history", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusMethodNotAllowed, "Get _history on collection: 405 not working")
+
+	hd = createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/item/_history", strings.NewReader(`{"depth": -1}`))
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusBadRequest, "Put _history: 400 not working")
+	teardownDB(db)
+}
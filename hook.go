@@ -2,11 +2,20 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"path"
+	"strings"
+	"time"
 )
 
 type HookCollection struct {
@@ -15,57 +24,551 @@ type HookCollection struct {
 }
 
 type Hook struct {
-	Id   string `json:"id"`
-	Name string `json:"name"`
-	URL  string `json:"url"`
-	//Fields      []string // limit fields to get
-	//Methods     []string // limit methods to forward
+	Id      string   `json:"id"`
+	Serial  string   `json:"serial,omitempty"` // set on creation, tells the hook apart from earlier hooks with the same ID
+	Name    string   `json:"name"`
+	URL     string   `json:"url"`
+	Secret  string   `json:"secret,omitempty"`  // key signing the events, never returned by a get
+	Methods []string `json:"methods,omitempty"` // methods calling the hook, all if empty
+	Fields  []string `json:"fields,omitempty"`  // names or JSON pointers of the fields of JSON items calling the hook on a change, all if empty
+
+	IncludeValue    bool `json:"includeValue,omitempty"`    // embed the new value of items in the events
+	IncludePrevious bool `json:"includePrevious,omitempty"` // embed the previous value of items in the events
+	Recursive       bool `json:"recursive,omitempty"`       // also called for modifications of descendants
+	Commands        bool `json:"commands,omitempty"`        // also called for changes of the hooks and the forward
+
+	Expires   *time.Time `json:"expires,omitempty"`   // the hook is not called anymore after this time
+	Suspended bool       `json:"suspended,omitempty"` // set after too many failed posts or a failed handshake, cleared by a put
+	Handshake bool       `json:"handshake,omitempty"` // the hook has to confirm its secret before it is called, off by default
+	Pending   bool       `json:"pending,omitempty"`   // set while the handshake has not been confirmed
+	Format    string     `json:"format,omitempty"`    // format of the events: gobus, cloudevents or cloudevents-binary
+
+	Headers  map[string]string `json:"headers,omitempty"`  // static headers sent with every event
+	Template string            `json:"template,omitempty"` // text/template rendering the body of the events instead of the format
+
+	BatchSize  int    `json:"batchSize,omitempty"`  // maximal number of events posted together as a JSON array, 0 to post every event alone
+	BatchDelay string `json:"batchDelay,omitempty"` // maximal wait for further events of a batch, e.g. 5s
+}
+
+// states of a hook, only active hooks are called
+const (
+	hookActive    = "active"
+	hookSuspended = "suspended"
+	hookPending   = "pending"
+	hookExpired   = "expired"
+)
+
+// returns the state of the hook at the given time
+func (h *Hook) state(now time.Time) string {
+	if h.Suspended {
+		return hookSuspended
+	}
+	if h.Pending {
+		return hookPending
+	}
+	if h.Expires != nil && !now.Before(*h.Expires) {
+		return hookExpired
+	}
+	return hookActive
+}
+
+// a hook as returned by a get, with its state and the counters of its deliveries
+type hookStatus struct {
+	*Hook
+	DeliveryStats
+	State string `json:"state"`
 }
 
 type HookEvent struct {
-	Name             string `json:"name"`
-	Method           string `json:"method"`
-	Item             bool   `json:"item"` // is the affected resource an item or a collection
-	ModifiedResource string `json:"path"` // relative path to the resource (caller needs to know server)
+	Name             string      `json:"name"`
+	Method           string      `json:"method"`
+	Item             bool        `json:"item"`               // is the affected resource an item or a collection
+	ModifiedResource string      `json:"path"`               // relative path to the resource (caller needs to know server)
+	Command          string      `json:"command,omitempty"`  // _hooks or _forward for changes of commands
+	Value            *EventValue `json:"value,omitempty"`    // new value of an item, if requested by the hook
+	Previous         *EventValue `json:"previous,omitempty"` // previous value of an item, if requested by the hook
 }
 
+// methods which can be selected by hooks
+// CREATE is the method of the event of a resource created by a PUT
+var hookMethods = []string{"CREATE", "DELETE", "PATCH", "POST", "PUT"}
+
+// parses a hook and checks its filters
 func parseHook(data []byte) (*Hook, error) {
 	var hook Hook
 	err := json.Unmarshal(data, &hook)
-	return &hook, err
+	if err != nil {
+		return &hook, err
+	}
+	for i, method := range hook.Methods {
+		hook.Methods[i] = strings.ToUpper(method)
+		if !contains(hookMethods, hook.Methods[i]) {
+			return &hook, errors.New(fmt.Sprintf("Invalid hook method %s", method))
+		}
+	}
+	for _, field := range hook.Fields {
+		_, err = fieldPointer(field)
+		if err != nil {
+			return &hook, err
+		}
+	}
+	if !contains(hookFormats, hook.Format) {
+		return &hook, errors.New(fmt.Sprintf("Invalid hook format %s", hook.Format))
+	}
+	for name, value := range hook.Headers {
+		err = checkHookHeader(name, value)
+		if err != nil {
+			return &hook, err
+		}
+	}
+	if hook.Template != "" {
+		if hook.Format == formatCloudEvents {
+			return &hook, errors.New("A hook template can not be used with the structured cloudevents format")
+		}
+		_, err = parseBodyTemplate(hook.Template)
+		if err != nil {
+			return &hook, errors.New(fmt.Sprintf("Invalid hook template: %v", err.Error()))
+		}
+	}
+	err = checkHookBatch(&hook)
+	if err != nil {
+		return &hook, err
+	}
+	return &hook, nil
+}
+
+// checks the batching of a hook, batches are JSON arrays of the events
+func checkHookBatch(hook *Hook) error {
+	if hook.BatchSize < 0 || hook.BatchSize > maxBatchSize {
+		return errors.New(fmt.Sprintf("Invalid hook batch size %d, at most %d", hook.BatchSize, maxBatchSize))
+	}
+	if hook.BatchSize == 0 {
+		if hook.BatchDelay != "" {
+			return errors.New("A hook batch delay requires a batch size")
+		}
+		return nil
+	}
+	if hook.Template != "" || hook.Format == formatCloudEventsBinary {
+		return errors.New("Batched hooks can not use templates or the binary cloudevents format")
+	}
+	delay, err := hook.batchDelay()
+	if err != nil {
+		return err
+	}
+	// without a delay the first event is due at once and every batch holds a single event
+	if hook.BatchSize > 1 && delay == 0 {
+		return errors.New("A hook batch size above 1 requires a batch delay")
+	}
+	return nil
+}
+
+// returns the maximal wait for further events of a batch
+func (h *Hook) batchDelay() (time.Duration, error) {
+	if h.BatchDelay == "" {
+		return 0, nil
+	}
+	delay, err := time.ParseDuration(h.BatchDelay)
+	if err != nil || delay < 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid hook batch delay %s", h.BatchDelay))
+	}
+	return delay, nil
+}
+
+// headers set by gobus which can not be given by a hook
+var reservedHookHeaders = []string{"Content-Length", "Host", hookSecretHeader, hookSignatureHeader}
+
+// checks a static header of a hook
+func checkHookHeader(name, value string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n:()<>@,;\\\"/[]?={}") {
+		return errors.New(fmt.Sprintf("Invalid hook header name %q", name))
+	}
+	if contains(reservedHookHeaders, http.CanonicalHeaderKey(name)) {
+		return errors.New(fmt.Sprintf("Hook header %s is reserved", name))
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return errors.New(fmt.Sprintf("Invalid value of hook header %s", name))
+	}
+	return nil
+}
+
+// returned instead of the values of the static headers of a hook, which may hold credentials
+// a put with this value keeps the value of the header
+const redactedHeader = "[redacted]"
+
+// hides the values of the static headers
+func (h *Hook) redactHeaders() {
+	for name := range h.Headers {
+		h.Headers[name] = redactedHeader
+	}
+}
+
+// replaces the redacted values of the static headers with the values of the old hook
+// a redacted header the old hook does not have is dropped
+func (h *Hook) keepHeaders(old *Hook) {
+	for name, value := range h.Headers {
+		if value != redactedHeader {
+			continue
+		}
+		delete(h.Headers, name)
+		for oldName, oldValue := range old.Headers {
+			if http.CanonicalHeaderKey(oldName) == http.CanonicalHeaderKey(name) {
+				h.Headers[name] = oldValue
+			}
+		}
+	}
+}
 
+// returns the tokens of a field, either the name of a member or a JSON pointer
+func fieldPointer(field string) ([]string, error) {
+	if field == "" {
+		return nil, errors.New("Empty hook field")
+	}
+	if strings.HasPrefix(field, "/") {
+		return parsePointer(field)
+	}
+	return []string{field}, nil
 }
 
-func callHooks(res Resource, method, basePath string) {
-	comps := res.GetElts()
-	resURL := path.Join(basePath, path.Join(comps...))
-	hooks, err := res.GetHooks()
+// checks if a list of strings contains a string
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// the decoded value of a JSON item before and after a modification
+type valueChange struct {
+	before interface{}
+	after  interface{}
+}
+
+// returns the change of an item value, nil if the values are not both JSON
+func newValueChange(oldType string, old []byte, newType string, value []byte) *valueChange {
+	if !isJSONType(oldType) || !isJSONType(newType) {
+		return nil
+	}
+	before, err := decodeJSON(old)
 	if err != nil {
-		log.Printf("Internal error, could not get hooks: %v", err.Error())
+		return nil
+	}
+	after, err := decodeJSON(value)
+	if err != nil {
+		return nil
+	}
+	return &valueChange{before, after}
+}
+
+// checks if the value of a field was changed, added or removed
+func (c *valueChange) changed(field string) bool {
+	tokens, err := fieldPointer(field)
+	if err != nil {
+		return true
+	}
+	before, beforeErr := getPointer(c.before, tokens)
+	after, afterErr := getPointer(c.after, tokens)
+	if beforeErr != nil || afterErr != nil {
+		return (beforeErr == nil) != (afterErr == nil)
+	}
+	return !jsonEqual(before, after)
+}
+
+// checks if the hook is called for an event
+// the fields are only checked if the change of a JSON item is known
+func (h *Hook) matches(event HookEvent, change *valueChange) bool {
+	if event.Command != "" && !h.Commands {
+		return false
+	}
+	if len(h.Methods) > 0 && !contains(h.Methods, event.Method) {
+		return false
+	}
+	if len(h.Fields) == 0 || change == nil {
+		return true
+	}
+	for _, field := range h.Fields {
+		if change.changed(field) {
+			return true
+		}
+	}
+	return false
+}
+
+// headers of the resthooks handshake and of the signature of events
+const (
+	hookSecretHeader    = "X-Hook-Secret"
+	hookSignatureHeader = "X-Hook-Signature"
+)
+
+// client used for the handshake with new hooks
+var handshakeClient = &http.Client{Timeout: 10 * time.Second}
+
+// returns size random bytes hex encoded
+func randomHex(size int) (string, error) {
+	b := make([]byte, size)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// returns a random secret for a hook
+func generateSecret() (string, error) {
+	return randomHex(32)
+}
+
+// returns the hex encoded HMAC-SHA256 of the payload
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sends the secret to the hook, which has to confirm the subscription by echoing it
+// see http://resthooks.org/docs/security/
+func handshake(hook *Hook) error {
+	request, err := http.NewRequest("POST", hook.URL, bytes.NewReader([]byte{}))
+	if err != nil {
+		return err
+	}
+	request.Header.Set(hookSecretHeader, hook.Secret)
+	response, err := handshakeClient.Do(request)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("Hook responded with status %d", response.StatusCode))
+	}
+	if response.Header.Get(hookSecretHeader) != hook.Secret {
+		return errors.New("Hook did not confirm the secret")
+	}
+	return nil
+}
+
+// runs the handshake of a pending hook, the hook is activated once confirmed and suspended otherwise
+// nothing is changed if the hook has been deleted or changed meanwhile
+func confirmHook(db GoBusDB, elts []string, hook *Hook) {
+	confirmErr := handshake(hook)
+	res, current, err := queueHook(db, hook.queue(elts))
+	if err != nil || !current.Pending || current.URL != hook.URL || current.Secret != hook.Secret {
 		return
 	}
+	current.Pending = false
+	if confirmErr != nil {
+		log.Printf("Handshake of hook %s failed: %v", hook.Name, confirmErr.Error())
+		current.Suspended = true
+	}
+	data, err := json.Marshal(current)
+	if err == nil {
+		err = res.SetHook(current.Id, data)
+	}
+	if err != nil {
+		log.Printf("Internal error, could not confirm hook %s: %v", hook.Name, err.Error())
+	}
+}
+
+// returns the URL path of a resource as reported in events
+func resourcePath(res Resource, basePath string) string {
+	return path.Join(basePath, path.Join(res.GetElts()...))
+}
+
+// a hook together with the elements of the resource it is defined on
+type resourceHook struct {
+	elts []string
+	hook *Hook
+}
+
+// the event of a modification and the hooks to notify about it
+type hookCall struct {
+	event    HookEvent
+	hooks    []resourceHook
+	value    *itemValue   // set for modifications of items
+	previous *itemValue   // set for modifications and deletions of items
+	change   *valueChange // set for modifications of JSON items
+	deleted  []string     // set for deletions, the elements of the resource deleted together with its hooks
+}
+
+// returns the hooks of the resource and the recursive hooks of its ancestors
+// all hooks of the parent are included if parent is set
+func collectHooks(db GoBusDB, res Resource, parent bool) ([]resourceHook, error) {
+	elts := res.GetElts()
+	hooks := []resourceHook{}
+	for i := 0; i <= len(elts); i++ {
+		r := res
+		if i < len(elts) {
+			var err error
+			r, err = db.GetResource(elts[:i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		resHooks, err := r.GetHooks()
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range resHooks {
+			if i == len(elts) || h.Recursive || (parent && i == len(elts)-1) {
+				hooks = append(hooks, resourceHook{elts[:i], h})
+			}
+		}
+	}
+	return hooks, nil
+}
+
+// collects everything needed to notify about a modification of the resource
+// for a deletion, this has to be done before the resource is deleted
+// the creation of a resource is also announced to the hooks of its parent
+func newHookCall(db GoBusDB, res Resource, method, basePath string) (*hookCall, error) {
 	isitem, err := res.IsItem()
 	if err != nil {
-		panic(err)
-		log.Printf("Internal error, could not get isitem: %v", err.Error())
+		return nil, err
+	}
+	hooks, err := collectHooks(db, res, method == "CREATE")
+	if err != nil {
+		return nil, err
+	}
+	event := HookEvent{
+		Method:           method,
+		Item:             isitem,
+		ModifiedResource: resourcePath(res, basePath),
+	}
+	call := &hookCall{event: event, hooks: hooks}
+	if isitem && method == "DELETE" {
+		ct, value, err := res.GetValue()
+		if err != nil {
+			return nil, err
+		}
+		call.previous = &itemValue{ct, value}
+	}
+	return call, nil
+}
+
+// publishes the event and queues it for delivery to all hooks
+func (c *hookCall) send(db GoBusDB) {
+	broker.publish(c.event)
+	now := time.Now()
+	id, err := randomHex(16)
+	if err != nil {
+		log.Printf("Internal error, could not generate event ID: %v", err.Error())
 		return
 	}
-	for _, h := range hooks {
-		var event = HookEvent{
-			Name:             h.Name,
-			Method:           method,
-			Item:             isitem,
-			ModifiedResource: resURL,
+	called := false
+	for _, rh := range c.hooks {
+		h := rh.hook
+		if h.state(now) != hookActive || !h.matches(c.event, c.change) {
+			continue
+		}
+		event := c.event
+		event.Name = h.Name
+		if h.IncludeValue && c.value != nil {
+			event.Value = c.value.embed()
+		}
+		if h.IncludePrevious && c.previous != nil {
+			event.Previous = c.previous.embed()
 		}
-		data, err := json.Marshal(event)
+		data, headers, err := formatEvent(h.Format, event, id, now)
 		if err != nil {
 			log.Printf("Failed to marshal hook %s", h.Name)
 			continue
 		}
-		go http.Post(h.URL, "application/json", bytes.NewReader(data))
+		if h.Template != "" {
+			data, err = renderBody(h.Template, event)
+			if err != nil {
+				log.Printf("Failed to render template of hook %s: %v", h.Name, err.Error())
+				continue
+			}
+		}
+		delivery := &Delivery{
+			Payload:     data,
+			Created:     now,
+			NextAttempt: now,
+		}
+		if len(headers) > 0 {
+			delivery.Headers = headers
+		}
+		if c.deleted != nil && len(rh.elts) == len(c.deleted) { // posted after the hook is gone
+			delivery.Hook = h
+		}
+		if h.BatchSize > 0 {
+			delay, _ := h.batchDelay()
+			delivery.Batch = h.BatchSize
+			delivery.NextAttempt = now.Add(delay)
+		}
+		err = db.EnqueueDelivery(h.queue(rh.elts), delivery)
+		if err != nil {
+			log.Printf("Internal error, could not queue event for hook %s: %v", h.Name, err.Error())
+			continue
+		}
+		called = true
+	}
+	if called {
+		wakeDispatchers(db)
 	}
 }
 
+// publishes the deletion of a resource and drops the delivery queues of its hooks
+// queues still holding events, like the one of this deletion, are dropped by the dispatcher once delivered
+func (c *hookCall) sendDeleted(db GoBusDB, elts []string) {
+	c.deleted = elts
+	c.send(db)
+	for _, rh := range c.hooks {
+		if len(rh.elts) == len(elts) { // a hook of the deleted resource, not of an ancestor
+			dropDrainedQueue(db, rh.hook.queue(rh.elts))
+		}
+	}
+}
+
+// publishes the event of a modification and delivers it to all hooks of the resource
+func callHooks(db GoBusDB, res Resource, method, basePath string) {
+	call, err := newHookCall(db, res, method, basePath)
+	if err != nil {
+		log.Printf("Internal error, could not get hooks: %v", err.Error())
+		return
+	}
+	call.send(db)
+}
+
+// publishes the modification of an item value and delivers it to the hooks interested in it
+func callItemHooks(db GoBusDB, res Resource, method, basePath string, oldType string, old []byte, newType string, value []byte) {
+	call, err := newHookCall(db, res, method, basePath)
+	if err != nil {
+		log.Printf("Internal error, could not get hooks: %v", err.Error())
+		return
+	}
+	call.previous = &itemValue{oldType, old}
+	call.value = &itemValue{newType, value}
+	call.change = newValueChange(oldType, old, newType, value)
+	call.send(db)
+}
+
+// announces a resource created by a put, with its value if it is an item
+func callCreateHooks(db GoBusDB, res Resource, basePath string, contentType string, value []byte) {
+	call, err := newHookCall(db, res, "CREATE", basePath)
+	if err != nil {
+		log.Printf("Internal error, could not get hooks: %v", err.Error())
+		return
+	}
+	if len(value) > 0 {
+		call.value = &itemValue{contentType, value}
+	}
+	call.send(db)
+}
+
+// announces the change of a command (_hooks or _forward) to the hooks asking for it
+func callCommandHooks(db GoBusDB, res Resource, method, command, basePath string) {
+	call, err := newHookCall(db, res, method, basePath)
+	if err != nil {
+		log.Printf("Internal error, could not get hooks: %v", err.Error())
+		return
+	}
+	call.event.Command = command
+	call.send(db)
+}
+
 // hook handlers
 // deletes an existing hook
 func deleteHook(hd *HandlerData, res Resource, cmds []string) {
@@ -73,12 +576,24 @@ func deleteHook(hd *HandlerData, res Resource, cmds []string) {
 		respond(hd, http.StatusNotFound, "Not Found")
 		return
 	}
-	err := res.DeleteHook(cmds[1])
+	hook, err := res.GetHook(cmds[1])
 	if err != nil {
 		respond(hd, http.StatusNotFound, "Not Found")
 		return
 	}
+	err = res.DeleteHook(cmds[1])
+	if err != nil {
+		respond(hd, http.StatusNotFound, "Not Found")
+		return
+	}
+	err = hd.DB.DeleteDeliveries(hook.queue(res.GetElts()))
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not delete deliveries")
+		return
+	}
 	respond(hd, http.StatusOK, "Deleted")
+
+	callCommandHooks(hd.DB, res, "DELETE", "_hooks", hd.BaseURL.Path)
 }
 
 // returns either a single hook specified by the ID or a list of all hooks
@@ -103,7 +618,14 @@ func getHook(hd *HandlerData, res Resource, cmds []string) {
 			respond(hd, http.StatusInternalServerError, "Could not get Hook")
 			break
 		}
-		data, err := json.Marshal(hook)
+		stats, err := hd.DB.GetDeliveryStats(hook.queue(res.GetElts()))
+		if err != nil {
+			respond(hd, http.StatusInternalServerError, "Could not get Hook deliveries")
+			break
+		}
+		hook.Secret = ""
+		hook.redactHeaders()
+		data, err := json.Marshal(hookStatus{hook, *stats, hook.state(time.Now())})
 		if err != nil {
 			respond(hd, http.StatusInternalServerError, "Could not get Hook Json")
 			break
@@ -115,6 +637,7 @@ func getHook(hd *HandlerData, res Resource, cmds []string) {
 }
 
 // create a new hook, returns the ID of the hook
+// its secret is returned in the X-Hook-Secret header, with handshake set the hook is pending until it confirmed the secret
 func postHook(hd *HandlerData, res Resource, cmds []string) {
 	if len(cmds) == 1 {
 		body := hd.R.Body
@@ -124,24 +647,55 @@ func postHook(hd *HandlerData, res Resource, cmds []string) {
 			respond(hd, http.StatusBadRequest, "Invalid Request")
 			return
 		}
+		hook, err := parseHook(data)
+		if err != nil {
+			respond(hd, http.StatusBadRequest, fmt.Sprintf("Invalid Hook: %v", err.Error()))
+			return
+		}
+		if hook.Secret == "" {
+			hook.Secret, err = generateSecret()
+			if err != nil {
+				respond(hd, http.StatusInternalServerError, "Could not generate secret")
+				return
+			}
+		}
+		hook.Serial, err = randomHex(8)
+		if err != nil {
+			respond(hd, http.StatusInternalServerError, "Could not generate serial")
+			return
+		}
+		hook.Pending = hook.Handshake
+		data, err = json.Marshal(hook)
+		if err != nil {
+			respond(hd, http.StatusInternalServerError, "Could not get Hook Json")
+			return
+		}
 		name, err := res.AddHook(data)
 		if err != nil {
 			respond(hd, http.StatusInternalServerError, "Could not create Hook")
 			return
 		}
-		respondCreatedNewURL(hd.W, hd.R.URL, name)
+		hd.W.Header().Set(hookSecretHeader, hook.Secret)
+		respondCreatedNewURL(hd, name)
+		if hook.Pending {
+			hook.Id = name
+			go confirmHook(hd.DB, res.GetElts(), hook)
+		}
+
+		callCommandHooks(hd.DB, res, "POST", "_hooks", hd.BaseURL.Path)
 	} else {
 		respond(hd, http.StatusMethodNotAllowed, "Method not allowed for hooks.")
 	}
 }
 
 // puts a hook, only permitted for existing hooks
-// new hooks have to be created with post
+// new hooks have to be created with post, the secret is kept if none is given, as are the values of redacted headers
+// the handshake is repeated if the URL or the secret changes
 func putHook(hd *HandlerData, res Resource, cmds []string) {
 	if len(cmds) == 2 {
-		_, err := res.GetHook(cmds[1])
+		old, err := res.GetHook(cmds[1])
 		if err != nil {
-			respond(hd, http.StatusInternalServerError, "Could not get Hook")
+			respond(hd, http.StatusNotFound, "Not Found")
 			return
 		}
 		body := hd.R.Body
@@ -151,12 +705,41 @@ func putHook(hd *HandlerData, res Resource, cmds []string) {
 			respond(hd, http.StatusBadRequest, "Invalid Request")
 			return
 		}
+		hook, err := parseHook(data)
+		if err != nil {
+			respond(hd, http.StatusBadRequest, fmt.Sprintf("Invalid Hook: %v", err.Error()))
+			return
+		}
+		if hook.Secret == "" {
+			hook.Secret = old.Secret
+		}
+		hook.keepHeaders(old)
+		hook.Id, hook.Serial = cmds[1], old.Serial
+		hook.Pending = hook.Handshake && !hook.Suspended &&
+			(old.Pending || old.Suspended || !old.Handshake || hook.URL != old.URL || hook.Secret != old.Secret)
+		data, err = json.Marshal(hook)
+		if err != nil {
+			respond(hd, http.StatusInternalServerError, "Could not get Hook Json")
+			return
+		}
 		err = res.SetHook(cmds[1], data)
 		if err != nil {
 			respond(hd, http.StatusInternalServerError, "Could not set Hook")
 			return
 		}
+		if old.Suspended && !hook.Suspended { // reactivated, give the hook a new chance
+			err = hd.DB.ResetDeliveryFailures(old.queue(res.GetElts()))
+			if err != nil {
+				respond(hd, http.StatusInternalServerError, "Could not reset Hook failures")
+				return
+			}
+		}
 		respond(hd, http.StatusOK, "Hook updated.")
+		if hook.Pending {
+			go confirmHook(hd.DB, res.GetElts(), hook)
+		}
+
+		callCommandHooks(hd.DB, res, "PUT", "_hooks", hd.BaseURL.Path)
 	} else {
 		respond(hd, http.StatusMethodNotAllowed, "Put only allowed on existing hooks.")
 	}
@@ -164,6 +747,10 @@ func putHook(hd *HandlerData, res Resource, cmds []string) {
 
 // handles requests for the _hook command
 func handleHookRequest(hd *HandlerData, res Resource, cmds []string) {
+	if len(cmds) > 2 {
+		handleHookDeliveryRequest(hd, res, cmds)
+		return
+	}
 	switch hd.R.Method {
 	case "DELETE":
 		deleteHook(hd, res, cmds)
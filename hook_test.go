@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseHook(t *testing.T) {
@@ -22,9 +23,9 @@ func TestParseHook(t *testing.T) {
 }
 
 func TestHandleGetHooks(t *testing.T) {
-	db := NewRedisDB()
+	db := newTestDB()
 	resPath := []string{"path", "res"}
-	res, _ := db.CreateResource(resPath, false)
+	res, _ := db.CreateResource(resPath, false, "", nil, time.Time{})
 	hookData := []byte(fmt.Sprintf(`{"name": "a_hook", "url": "http://test.com/a/hook"}`))
 	res.AddHook(hookData)
 
@@ -45,13 +46,13 @@ func TestHandleGetHooks(t *testing.T) {
 	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/path/res/_hooks/0/a", nil)
 	handleRequest(hd)
 	checkCode(t, hd, http.StatusNotFound, "Get hooks: 404 not working")
-	teardownRedis(db)
+	teardownDB(db)
 }
 
 func TestHandlePutHooks(t *testing.T) {
-	db := NewRedisDB()
+	db := newTestDB()
 	resPath := []string{"path", "res"}
-	res, _ := db.CreateResource(resPath, false)
+	res, _ := db.CreateResource(resPath, false, "", nil, time.Time{})
 	hookData := []byte(fmt.Sprintf(`{"name": "a_hook", "url": "http://test.com/a/hook"}`))
 	res.AddHook(hookData)
 
@@ -64,16 +65,18 @@ func TestHandlePutHooks(t *testing.T) {
 		t.Error("Get Hook: content not set")
 	}
 
-	teardownRedis(db)
+	teardownDB(db)
 }
 
 func TestHandleHooking(t *testing.T) {
-	db := NewRedisDB()
+	db := newTestDB()
 	resPath := []string{"an_item"}
-	res, err := db.CreateResource(resPath, false)
+	res, err := db.CreateResource(resPath, false, "", nil, time.Time{})
 	if err != nil {
 		t.Fatal(err)
 	}
+	stop := startTestDispatcher(db)
+	defer stop()
 
 	// start server for hook test
 	c := make(chan []byte)
@@ -107,5 +110,218 @@ func TestHandleHooking(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	teardownRedis(db)
+	teardownDB(db)
+}
+
+func TestHookHandshake(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"an_item"}, false, "", nil, time.Time{})
+	confirm := make(chan string)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Hook-Secret") != "" {
+			w.Header().Set("X-Hook-Secret", <-confirm)
+		}
+	}))
+	defer ts.Close()
+	state := func() string {
+		hd := createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/an_item/_hooks/0", nil)
+		handleRequest(hd)
+		var status hookStatus
+		json.Unmarshal(hd.W.(*httptest.ResponseRecorder).Body.Bytes(), &status)
+		return status.State
+	}
+
+	hookData := strings.NewReader(fmt.Sprintf(`{"name": "hook_name", "url": "%s", "secret": "s3cr3t", "handshake": true}`, ts.URL))
+	hd := createHandlerData(t, db, "POST", "http://localhost:8080/asdf/qwer/an_item/_hooks", hookData)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusCreated, "Post Hook with handshake: 201 not working")
+	if s := state(); s != "pending" {
+		t.Error("Unconfirmed hook not pending", s)
+	}
+	callHooks(db, res, "PUT", "/")
+	hook, _ := res.GetHook("0")
+	if deliveries, _ := db.GetDeliveries(hook.queue(res.GetElts())); len(deliveries) != 0 {
+		t.Error("Event queued for pending hook", deliveries)
+	}
+	confirm <- "s3cr3t"
+	waitFor(t, func() bool { return state() == "active" }, "Confirmed hook not activated")
+
+	// a new secret is confirmed again
+	data := strings.NewReader(fmt.Sprintf(`{"name": "hook_name", "url": "%s", "secret": "n3w", "handshake": true}`, ts.URL))
+	hd = createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/an_item/_hooks/0", data)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Put hook: 200 not working")
+	if s := state(); s != "pending" {
+		t.Error("Hook with changed secret not pending", s)
+	}
+	confirm <- "wrong"
+	waitFor(t, func() bool { return state() == "suspended" }, "Unconfirmed hook not suspended")
+
+	hd = createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/an_item/_hooks/7", strings.NewReader(`{"name": "h", "url": "http://test.com"}`))
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusNotFound, "Put inexisting hook: 404 not working")
+	teardownDB(db)
+}
+
+func TestHookSecret(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"an_item"}, false, "", nil, time.Time{})
+	res.AddHook([]byte(`{"name": "a_hook", "url": "http://test.com/a/hook", "secret": "s3cr3t"}`))
+	callHooks(db, res, "PUT", "/")
+	deliveries, _ := db.GetDeliveries(hookQueue(res.GetElts(), "0"))
+	hook, _ := res.GetHook("0")
+	if post, _ := newHookPost(hook, deliveries); len(deliveries) != 1 || post.Headers[hookSignatureHeader] != signPayload("s3cr3t", post.Payload) {
+		t.Error("Hook event not signed", deliveries)
+	}
+
+	// the secret is kept on put and not returned on get
+	data := strings.NewReader(`{"name": "a_hook", "url": "http://blup.com/a/hook"}`)
+	hd := createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/an_item/_hooks/0", data)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Put hook: 200 not working")
+	if h, _ := res.GetHook("0"); h.Secret != "s3cr3t" {
+		t.Error("Put hook: secret not kept", h.Secret)
+	}
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/an_item/_hooks/0", nil)
+	handleRequest(hd)
+	if strings.Contains(hd.W.(*httptest.ResponseRecorder).Body.String(), "s3cr3t") {
+		t.Error("Get hook: secret returned")
+	}
+	teardownDB(db)
+}
+
+func TestParseHookFilters(t *testing.T) {
+	hook, err := parseHook([]byte(`{"name": "h", "url": "http://test.com", "methods": ["put", "DELETE"], "fields": ["name", "/address/city"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hook.Methods) != 2 || hook.Methods[0] != "PUT" || len(hook.Fields) != 2 {
+		t.Error("Hook filters not set", hook.Methods, hook.Fields)
+	}
+	for _, data := range []string{
+		`{"name": "h", "url": "http://test.com", "methods": ["GET"]}`,
+		`{"name": "h", "url": "http://test.com", "fields": [""]}`,
+		`{"name": "h", "url": "http://test.com", "headers": {"bad header": "x"}}`,
+		`{"name": "h", "url": "http://test.com", "headers": {"x-hook-signature": "x"}}`,
+		`{"name": "h", "url": "http://test.com", "headers": {"X-Token": "a\r\nHost: evil"}}`,
+		`{"name": "h", "url": "http://test.com", "template": "{{.name"}`,
+		`{"name": "h", "url": "http://test.com", "template": "{{.name}}", "format": "cloudevents"}`,
+		`{"name": "h", "url": "http://test.com", "batchSize": 1000}`,
+		`{"name": "h", "url": "http://test.com", "batchDelay": "1s"}`,
+		`{"name": "h", "url": "http://test.com", "batchSize": 10, "batchDelay": "soon"}`,
+		`{"name": "h", "url": "http://test.com", "batchSize": 10}`,
+		`{"name": "h", "url": "http://test.com", "batchSize": 10, "batchDelay": "0s"}`,
+		`{"name": "h", "url": "http://test.com", "batchSize": 10, "template": "{{.name}}"}`,
+	} {
+		if _, err := parseHook([]byte(data)); err == nil {
+			t.Error("Invalid hook filter accepted", data)
+		}
+	}
+}
+
+func TestHookFilters(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"filtered"}, true, "", nil, time.Time{})
+	res.AddHook([]byte(`{"name": "all", "url": "http://test.com/all"}`))
+	res.AddHook([]byte(`{"name": "deletes", "url": "http://test.com/deletes", "methods": ["DELETE"]}`))
+	res.AddHook([]byte(`{"name": "city", "url": "http://test.com/city", "fields": ["/address/city"]}`))
+	queued := func(id string) int {
+		deliveries, _ := db.GetDeliveries(hookQueue(res.GetElts(), id))
+		return len(deliveries)
+	}
+
+	old := []byte(`{"name": "a", "address": {"city": "Bern"}}`)
+	callItemHooks(db, res, "PUT", "/", "application/json", old, "application/json", []byte(`{"name": "b", "address": {"city": "Bern"}}`))
+	if queued("0") != 1 || queued("1") != 0 || queued("2") != 0 {
+		t.Error("Unchanged field: wrong hooks called", queued("0"), queued("1"), queued("2"))
+	}
+	callItemHooks(db, res, "PATCH", "/", "application/json", old, "application/json", []byte(`{"name": "a", "address": {"city": 1}}`))
+	if queued("2") != 1 {
+		t.Error("Changed field: hook not called")
+	}
+	callItemHooks(db, res, "PUT", "/", "application/json", old, "application/json", []byte(`{"name": "a"}`))
+	if queued("2") != 2 {
+		t.Error("Removed field: hook not called")
+	}
+	callItemHooks(db, res, "PUT", "/", "text/plain", []byte("bla"), "text/plain", []byte("blup"))
+	if queued("2") != 3 {
+		t.Error("Not JSON: hook not called")
+	}
+	callHooks(db, res, "DELETE", "/")
+	if queued("0") != 5 || queued("1") != 1 || queued("2") != 4 {
+		t.Error("Delete: wrong hooks called", queued("0"), queued("1"), queued("2"))
+	}
+
+	hd := createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/filtered/_hooks/1", strings.NewReader(`{"name": "h", "url": "http://test.com", "methods": ["GET"]}`))
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusBadRequest, "Invalid filter: 400 not working")
+	teardownDB(db)
+}
+
+func TestRecursiveHooks(t *testing.T) {
+	db := newTestDB()
+	devices, _ := db.CreateResource([]string{"devices"}, false, "", nil, time.Time{})
+	db.CreateResource([]string{"devices", "42"}, false, "", nil, time.Time{})
+	db.CreateResource([]string{"devices", "42", "readings"}, false, "", nil, time.Time{})
+	devices.AddHook([]byte(`{"name": "direct", "url": "http://test.com/direct"}`))
+	devices.AddHook([]byte(`{"name": "subtree", "url": "http://test.com/subtree", "recursive": true}`))
+
+	hd := createHandlerData(t, db, "POST", "http://localhost:8080/asdf/qwer/devices/42/readings", strings.NewReader("17"))
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusCreated, "Post: 201 not working")
+
+	if deliveries, _ := db.GetDeliveries(hookQueue(devices.GetElts(), "0")); len(deliveries) != 0 {
+		t.Error("Hook called for descendant", deliveries)
+	}
+	deliveries, _ := db.GetDeliveries(hookQueue(devices.GetElts(), "1"))
+	if len(deliveries) != 1 {
+		t.Fatal("Recursive hook not called", deliveries)
+	}
+	var event HookEvent
+	json.Unmarshal(deliveries[0].Payload, &event)
+	if event.Name != "subtree" || event.Method != "POST" || event.ModifiedResource != "/asdf/qwer/devices/42/readings" {
+		t.Error("Wrong event for descendant", event)
+	}
+	teardownDB(db)
+}
+
+func TestCreateAndCommandHooks(t *testing.T) {
+	db := newTestDB()
+	coll, _ := db.CreateResource([]string{"coll"}, false, "", nil, time.Time{})
+	coll.AddHook([]byte(`{"name": "children", "url": "http://test.com/children", "includeValue": true}`))
+	coll.AddHook([]byte(`{"name": "commands", "url": "http://test.com/commands", "commands": true}`))
+	events := func(id string) []HookEvent {
+		deliveries, _ := db.GetDeliveries(hookQueue(coll.GetElts(), id))
+		events := []HookEvent{}
+		for _, d := range deliveries {
+			var event HookEvent
+			json.Unmarshal(d.Payload, &event)
+			events = append(events, event)
+		}
+		return events
+	}
+
+	hd := createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/coll/child", strings.NewReader("bla"))
+	hd.R.Header.Set("Content-Type", "text/plain")
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusCreated, "Create: 201 not working")
+	created := events("0")
+	if len(created) != 1 || created[0].Method != "CREATE" || created[0].ModifiedResource != "/asdf/qwer/coll/child" ||
+		created[0].Value == nil || string(created[0].Value.Data) != `"bla"` {
+		t.Error("Create: parent hook not called", created)
+	}
+
+	hd = createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/coll/_forward", strings.NewReader(`{"url": "http://test.com/fwd"}`))
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Put forward: 200 not working")
+	hd = createHandlerData(t, db, "DELETE", "http://localhost:8080/asdf/qwer/coll/_hooks/0", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Delete hook: 200 not working")
+
+	commands := events("1")
+	if len(commands) != 3 || commands[1].Command != "_forward" || commands[1].Method != "PUT" ||
+		commands[2].Command != "_hooks" || commands[2].Method != "DELETE" {
+		t.Error("Command changes not announced", commands)
+	}
+	teardownDB(db)
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// longest time a GET waits for a change
+const maxWait = 5 * time.Minute
+
+// interval at which a waiting GET checks the version
+// the broker only publishes the changes made by this process, not those of other gobus processes
+// sharing the database
+const changePollInterval = time.Second
+
+// parses the wait parameter in seconds, it is limited to maxWait
+func parseWait(value string) (time.Duration, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid wait %s", value))
+	}
+	wait := time.Duration(seconds) * time.Second
+	if wait > maxWait || wait < 0 {
+		wait = maxWait
+	}
+	return wait, nil
+}
+
+// checks if the client knows the given version
+// the known version is given in If-None-Match or the version parameter
+func knownVersion(hd *HandlerData, version int64) bool {
+	if ifNoneMatch := hd.R.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, version, true) {
+		return true
+	}
+	known := hd.R.URL.Query().Get("version")
+	return known != "" && known == strconv.FormatInt(version, 10)
+}
+
+// blocks a GET with the wait parameter while the client knows the current version
+// it returns when the resource changes or after wait seconds
+// sends a "Not Modified" (304) if nothing changed, a "Not Found" (404) if the resource is deleted
+// returns false if a response has been sent
+func awaitChange(hd *HandlerData, res Resource) bool {
+	value := hd.R.URL.Query().Get("wait")
+	if value == "" {
+		return true
+	}
+	wait, err := parseWait(value)
+	if err != nil {
+		respond(hd, http.StatusBadRequest, err.Error())
+		return false
+	}
+	// subscribe before checking the version to not miss a change in between
+	// children are included as they change the version of a collection
+	sub, _ := broker.subscribe(resourcePath(res, hd.BaseURL.Path), true, -1)
+	defer func() { broker.unsubscribe(sub) }()
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	poll := time.NewTicker(changePollInterval)
+	defer poll.Stop()
+	for {
+		exists, err := hd.DB.ResourceExists(res.GetElts())
+		if err != nil {
+			respond(hd, http.StatusInternalServerError, "Could not get Resource")
+			return false
+		}
+		if !exists {
+			respond(hd, http.StatusNotFound, "Resource has been deleted.")
+			return false
+		}
+		version, err := res.Version()
+		if err != nil {
+			respond(hd, http.StatusInternalServerError, "Could not get version.")
+			return false
+		}
+		if !knownVersion(hd, version) {
+			return true
+		}
+		select {
+		case _, ok := <-sub.events:
+			if !ok { // too many events, check and subscribe again
+				sub, _ = broker.subscribe(resourcePath(res, hd.BaseURL.Path), true, -1)
+			}
+		case <-poll.C:
+		case <-timeout.C:
+			hd.W.Header().Set("ETag", etag(version))
+			hd.W.WriteHeader(http.StatusNotModified)
+			return false
+		case <-hd.R.Context().Done():
+			return false
+		}
+	}
+}
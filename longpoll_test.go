@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWait(t *testing.T) {
+	if wait, err := parseWait("30"); err != nil || wait != 30*time.Second {
+		t.Error("Wait not parsed", wait, err)
+	}
+	if wait, _ := parseWait("100000"); wait != maxWait {
+		t.Error("Wait not limited", wait)
+	}
+	for _, value := range []string{"-1", "a"} {
+		if _, err := parseWait(value); err == nil {
+			t.Error("Invalid wait accepted", value)
+		}
+	}
+}
+
+// runs the request in the background, the returned channel is closed when it is done
+func handleInBackground(hd *HandlerData) chan bool {
+	done := make(chan bool)
+	go func() {
+		handleRequest(hd)
+		close(done)
+	}()
+	return done
+}
+
+// waits for a background request
+func waitDone(t *testing.T, done chan bool, msg string) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal(msg)
+	}
+}
+
+func TestHandleLongPoll(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"poll", "item"}, true, "", nil, time.Time{})
+	res.SetValue("text/plain", []byte("bla"))
+	version, _ := res.Version()
+
+	// returns immediately if the version is outdated
+	hd := createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/poll/item?wait=10", nil)
+	hd.R.Header.Set("If-None-Match", `"0"`)
+	waitDone(t, handleInBackground(hd), "Outdated version: request blocked")
+	checkCode(t, hd, http.StatusOK, "Outdated version: 200 not working")
+
+	// times out without change
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/poll/item?wait=0", nil)
+	hd.R.Header.Set("If-None-Match", etag(version))
+	waitDone(t, handleInBackground(hd), "Timeout: request blocked")
+	checkCode(t, hd, http.StatusNotModified, "Timeout: 304 not working")
+
+	// returns the new value on a change
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/poll/item?wait=10&version="+strconv.FormatInt(version, 10), nil)
+	done := handleInBackground(hd)
+	select {
+	case <-done:
+		t.Fatal("Change: request not blocked")
+	case <-time.After(100 * time.Millisecond):
+	}
+	put := createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/poll/item", strings.NewReader("blup"))
+	handleRequest(put)
+	waitDone(t, done, "Change: request not woken up")
+	checkCode(t, hd, http.StatusOK, "Change: 200 not working")
+	if hd.W.(*httptest.ResponseRecorder).Body.String() != "blup" {
+		t.Error("Change: new value not returned", hd.W.(*httptest.ResponseRecorder).Body.String())
+	}
+
+	// a collection is woken up by changes of its children
+	coll, _ := db.GetResource([]string{"poll"})
+	version, _ = coll.Version()
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/poll?wait=10", nil)
+	hd.R.Header.Set("If-None-Match", etag(version))
+	done = handleInBackground(hd)
+	time.Sleep(50 * time.Millisecond)
+	del := createHandlerData(t, db, "DELETE", "http://localhost:8080/asdf/qwer/poll/item", nil)
+	handleRequest(del)
+	waitDone(t, done, "Collection: request not woken up")
+	checkCode(t, hd, http.StatusOK, "Collection: 200 not working")
+
+	// changes not published to the broker (e.g. by another process) are found by polling
+	res, _ = db.CreateResource([]string{"poll", "other"}, true, "text/plain", []byte("bla"), time.Time{})
+	version, _ = res.Version()
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/poll/other?wait=10", nil)
+	hd.R.Header.Set("If-None-Match", etag(version))
+	done = handleInBackground(hd)
+	time.Sleep(50 * time.Millisecond)
+	res.SetValue("text/plain", []byte("blup"))
+	waitDone(t, done, "Unpublished change: request not woken up")
+	checkCode(t, hd, http.StatusOK, "Unpublished change: 200 not working")
+
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/poll?wait=never", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusBadRequest, "Invalid wait: 400 not working")
+	teardownDB(db)
+}
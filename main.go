@@ -3,8 +3,8 @@ package main
 import (
 	"log"
 	"net/http"
-	"net/url"
 	"os"
+	"time"
 )
 
 func main() {
@@ -13,9 +13,31 @@ func main() {
 		port = "8080"
 	}
 
-	rootURL, _ := url.Parse("http://localhost:8080/")
-	db := NewRedisDB()
+	baseURL, err := baseURLFromEnv(port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	trustForwarded, err := envBool("TRUST_FORWARDED")
+	if err != nil {
+		log.Fatal(err)
+	}
+	dbConfig, err := dbConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	deliveryConfig, err := deliveryConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := NewDB(dbConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	eventSource = baseURL.String()
+	go runExpiry(db, baseURL.Path, time.Second)
+	go newDispatcher(db, deliveryConfig).run(time.Second, nil)
 
-	http.HandleFunc("/", getHandler(db, rootURL))
+	http.HandleFunc(baseURL.Path, getHandler(db, baseURL, trustForwarded))
 	log.Fatal(http.ListenAndServe(":"+port, nil))
 }
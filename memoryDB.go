@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// in-process record store, nothing is persisted
+type memoryStore struct {
+	mutex   sync.RWMutex
+	records map[string]*resourceRecord
+}
+
+// a transaction on the memory store
+// writes are buffered and only applied on commit
+type memoryTx struct {
+	store  *memoryStore
+	writes map[string]*resourceRecord // nil marks a deleted record
+}
+
+var errReadOnlyTx = errors.New("Can not write in a read-only transaction")
+
+// creates a GoBusDB which keeps all resources in memory
+func NewMemoryDB() GoBusDB {
+	store := &memoryStore{records: map[string]*resourceRecord{}}
+	db, err := newRecordDB(store)
+	if err != nil { // can not happen for the memory store
+		panic(err)
+	}
+	return db
+}
+
+func (s *memoryStore) update(f func(tx recordTx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tx := &memoryTx{s, map[string]*resourceRecord{}}
+	err := f(tx)
+	if err != nil {
+		return err
+	}
+	for key, rec := range tx.writes {
+		if rec == nil {
+			delete(s.records, key)
+		} else {
+			s.records[key] = rec
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) view(f func(tx recordTx) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return f(&memoryTx{s, nil})
+}
+
+func (tx *memoryTx) get(key string) (*resourceRecord, error) {
+	rec, written := tx.writes[key]
+	if !written {
+		rec = tx.store.records[key]
+	}
+	if rec == nil {
+		return nil, nil
+	}
+	return rec.clone(), nil
+}
+
+func (tx *memoryTx) put(key string, rec *resourceRecord) error {
+	if tx.writes == nil {
+		return errReadOnlyTx
+	}
+	tx.writes[key] = rec.clone()
+	return nil
+}
+
+func (tx *memoryTx) delete(key string) error {
+	if tx.writes == nil {
+		return errReadOnlyTx
+	}
+	tx.writes[key] = nil
+	return nil
+}
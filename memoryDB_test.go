@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T) (GoBusDB, func()) {
+		return NewMemoryDB(), func() {}
+	})
+}
+
+func TestMemoryRollback(t *testing.T) {
+	db := NewMemoryDB().(*RecordDB)
+	err := db.store.update(func(tx recordTx) error {
+		tx.put("root:x", newRecord("x", true))
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Error("update error not returned")
+	}
+	if exists, _ := db.ResourceExists([]string{"x"}); exists {
+		t.Error("aborted update got applied")
+	}
+}
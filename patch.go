@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// supported patch formats
+const (
+	mergePatchType = "application/merge-patch+json" // RFC 7396
+	jsonPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+// number of attempts to apply a patch if the item is modified concurrently
+const patchAttempts = 10
+
+var errNotJSON = errors.New("Item value is not JSON")
+var errPatchTestFailed = errors.New("Patch test failed")
+
+// a single operation of a JSON Patch
+type patchOperation struct {
+	Op    string           `json:"op"`
+	Path  *string          `json:"path"`
+	From  *string          `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// checks if the content type denotes a JSON document
+func isJSONType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// decodes a JSON document, numbers are kept as json.Number to not lose precision
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("Trailing data after JSON document")
+	}
+	return doc, nil
+}
+
+// applies a JSON Merge Patch to doc
+func mergePatch(doc interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	docObj, ok := doc.(map[string]interface{})
+	if !ok {
+		docObj = map[string]interface{}{}
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(docObj, k)
+		} else {
+			docObj[k] = mergePatch(docObj[k], v)
+		}
+	}
+	return docObj
+}
+
+// splits a JSON Pointer (RFC 6901) into its unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.New(fmt.Sprintf("Invalid JSON pointer %s", pointer))
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// parses an array index, end is the largest index allowed
+func arrayIndex(token string, end int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > end || (len(token) > 1 && token[0] == '0') {
+		return 0, errors.New(fmt.Sprintf("Invalid array index %s", token))
+	}
+	return i, nil
+}
+
+// returns the value doc contains at the given token
+func getChild(doc interface{}, token string) (interface{}, error) {
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		child, ok := container[token]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Member %s not found", token))
+		}
+		return child, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(container)-1)
+		if err != nil {
+			return nil, err
+		}
+		return container[i], nil
+	}
+	return nil, errors.New(fmt.Sprintf("Can not find %s in a value", token))
+}
+
+// returns the value at the pointer
+func getPointer(doc interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		child, err := getChild(doc, token)
+		if err != nil {
+			return nil, err
+		}
+		doc = child
+	}
+	return doc, nil
+}
+
+// applies f to the container of the last token and returns the modified document
+func modifyPointer(doc interface{}, tokens []string, f func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return f(doc, tokens[0])
+	}
+	child, err := getChild(doc, tokens[0])
+	if err != nil {
+		return nil, err
+	}
+	child, err = modifyPointer(child, tokens[1:], f)
+	if err != nil {
+		return nil, err
+	}
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		container[tokens[0]] = child
+	case []interface{}:
+		i, _ := strconv.Atoi(tokens[0])
+		container[i] = child
+	}
+	return doc, nil
+}
+
+// adds value at the pointer, array elements are inserted
+func addPointer(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return modifyPointer(doc, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			if token == "-" {
+				return append(c, value), nil
+			}
+			i, err := arrayIndex(token, len(c))
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		return nil, errors.New(fmt.Sprintf("Can not add %s to a value", token))
+	})
+}
+
+// removes the value at the pointer
+func removePointer(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("Can not remove the whole document")
+	}
+	return modifyPointer(doc, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[token]; !ok {
+				return nil, errors.New(fmt.Sprintf("Member %s not found", token))
+			}
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, errors.New(fmt.Sprintf("Can not remove %s from a value", token))
+	})
+}
+
+// compares two decoded JSON values, numbers are compared by value
+func jsonEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			if w, ok := bv[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		af, aerr := av.Float64()
+		bf, berr := bv.Float64()
+		return aerr == nil && berr == nil && af == bf
+	}
+	return a == b
+}
+
+// returns a deep copy of a decoded JSON value
+func copyJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		c := map[string]interface{}{}
+		for k, e := range v {
+			c[k] = copyJSON(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = copyJSON(e)
+		}
+		return c
+	}
+	return value
+}
+
+// parses a JSON Patch document
+func parseJSONPatch(data []byte) ([]patchOperation, error) {
+	var ops []patchOperation
+	err := json.Unmarshal(data, &ops)
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range ops {
+		if op.Path == nil {
+			return nil, errors.New("Patch operation without path")
+		}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, errors.New(fmt.Sprintf("Patch operation %s without value", op.Op))
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return nil, errors.New(fmt.Sprintf("Patch operation %s without from", op.Op))
+			}
+		case "remove":
+		default:
+			return nil, errors.New(fmt.Sprintf("Invalid patch operation %s", op.Op))
+		}
+	}
+	return ops, nil
+}
+
+// applies a single JSON Patch operation to doc
+func applyOperation(doc interface{}, op patchOperation) (interface{}, error) {
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if op.Value != nil {
+		value, err = decodeJSON(*op.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch op.Op {
+	case "add":
+		return addPointer(doc, path, value)
+	case "remove":
+		return removePointer(doc, path)
+	case "replace":
+		if _, err := getPointer(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return value, nil
+		}
+		doc, err = removePointer(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return addPointer(doc, path, value)
+	case "test":
+		current, err := getPointer(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(current, value) {
+			return nil, errPatchTestFailed
+		}
+		return doc, nil
+	}
+	// move and copy
+	from, err := parsePointer(*op.From)
+	if err != nil {
+		return nil, err
+	}
+	value, err = getPointer(doc, from)
+	if err != nil {
+		return nil, err
+	}
+	if op.Op == "copy" {
+		return addPointer(doc, path, copyJSON(value))
+	}
+	if strings.HasPrefix(*op.Path+"/", *op.From+"/") {
+		if *op.Path == *op.From {
+			return doc, nil
+		}
+		return nil, errors.New("Can not move a value into itself")
+	}
+	doc, err = removePointer(doc, from)
+	if err != nil {
+		return nil, err
+	}
+	return addPointer(doc, path, value)
+}
+
+// applies a JSON Patch to doc, all operations are applied or none
+func jsonPatch(doc interface{}, ops []patchOperation) (interface{}, error) {
+	var err error
+	for _, op := range ops {
+		doc, err = applyOperation(doc, op)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// applies a patch of the given type to a JSON value
+func applyPatch(patchType string, value []byte, patch []byte) ([]byte, error) {
+	doc, err := decodeJSON(value)
+	if err != nil {
+		return nil, errNotJSON
+	}
+	switch patchType {
+	case mergePatchType:
+		p, err := decodeJSON(patch)
+		if err != nil {
+			return nil, err
+		}
+		doc = mergePatch(doc, p)
+	case jsonPatchType:
+		ops, err := parseJSONPatch(patch)
+		if err != nil {
+			return nil, err
+		}
+		doc, err = jsonPatch(doc, ops)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// checks if the patch document is well formed
+func validPatch(patchType string, patch []byte) bool {
+	if patchType == jsonPatchType {
+		_, err := parseJSONPatch(patch)
+		return err == nil
+	}
+	_, err := decodeJSON(patch)
+	return err == nil
+}
+
+// patches a JSON item
+// the patch is applied against the stored value and only written if the item did not change meanwhile
+func patchItem(hd *HandlerData, res Resource) {
+	patchType, _, _ := mime.ParseMediaType(hd.R.Header.Get("Content-Type"))
+	if patchType != mergePatchType && patchType != jsonPatchType {
+		hd.W.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		respond(hd, http.StatusUnsupportedMediaType, "Unsupported patch format.")
+		return
+	}
+	body := hd.R.Body
+	patch, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		respond(hd, http.StatusBadRequest, "Invalid Request")
+		return
+	}
+	if !validPatch(patchType, patch) {
+		respond(hd, http.StatusBadRequest, "Invalid patch document.")
+		return
+	}
+	expected, ok := checkPreconditions(hd, res)
+	if !ok {
+		return
+	}
+	for attempt := 0; attempt < patchAttempts; attempt++ {
+		version := expected
+		if version == anyVersion {
+			version, err = res.Version()
+			if err != nil {
+				respond(hd, http.StatusInternalServerError, "Could not get version.")
+				return
+			}
+		}
+		ct, value, err := res.GetValue()
+		if err != nil {
+			respond(hd, http.StatusInternalServerError, "Could not get item value.")
+			return
+		}
+		if !isJSONType(ct) {
+			respond(hd, http.StatusConflict, fmt.Sprintf("Only JSON items can be patched, item is %s.", ct))
+			return
+		}
+		patched, err := applyPatch(patchType, value, patch)
+		if err == errNotJSON {
+			respond(hd, http.StatusConflict, "Item value is not valid JSON.")
+			return
+		}
+		if err == errPatchTestFailed {
+			respond(hd, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			respond(hd, http.StatusUnprocessableEntity, fmt.Sprintf("Could not apply patch: %s", err.Error()))
+			return
+		}
+		newVersion, err := res.SetValueIfVersion(ct, patched, version, time.Time{})
+		if err == errVersionMismatch {
+			if expected != anyVersion {
+				respond(hd, http.StatusPreconditionFailed, "Resource has been modified.")
+				return
+			}
+			continue // modified concurrently, patch the new value
+		}
+		if err != nil {
+			respond(hd, http.StatusInternalServerError, "Could not set item value.")
+			return
+		}
+		hd.W.Header().Set("ETag", etag(newVersion))
+		respond(hd, http.StatusOK, fmt.Sprintf("Patched %s!", patched))
+
+		callItemHooks(hd.DB, res, "PATCH", hd.BaseURL.Path, ct, value, ct, patched)
+		return
+	}
+	respond(hd, http.StatusConflict, "Item is modified too often, could not apply patch.")
+}
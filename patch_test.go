@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checks that two JSON documents are equal
+func checkJSON(t *testing.T, got, expected []byte, msg string) {
+	g, err := decodeJSON(got)
+	if err != nil {
+		t.Error(msg, "invalid JSON", string(got))
+		return
+	}
+	e, _ := decodeJSON(expected)
+	if !jsonEqual(g, e) {
+		t.Error(msg, string(got), "!=", string(expected))
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	// examples from RFC 7396
+	cases := [][]string{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, c := range cases {
+		patched, err := applyPatch(mergePatchType, []byte(c[0]), []byte(c[1]))
+		if err != nil {
+			t.Error("Merge patch failed", c, err)
+			continue
+		}
+		checkJSON(t, patched, []byte(c[2]), "Merge patch")
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	// examples from RFC 6902
+	cases := [][]string{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"}]`, `{"foo":{"bar":1},"baz":{"bar":1}}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`},
+		{`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10},{"op":"remove","path":"/~1"}]`, `{"~1":10}`},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+	}
+	for _, c := range cases {
+		patched, err := applyPatch(jsonPatchType, []byte(c[0]), []byte(c[1]))
+		if err != nil {
+			t.Error("JSON patch failed", c, err)
+			continue
+		}
+		checkJSON(t, patched, []byte(c[2]), "JSON patch")
+	}
+
+	failing := [][]string{
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`},
+		{`{"foo":[1]}`, `[{"op":"add","path":"/foo/2","value":2}]`},
+		{`{"foo":[1]}`, `[{"op":"add","path":"/foo/01","value":2}]`},
+		{`{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/a","value":1},{"op":"remove","path":"/b"}]`},
+		{`{"foo":"bar"}`, `[{"op":"invalid","path":"/foo"}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/foo"}]`},
+		{`not json`, `[]`},
+	}
+	for _, c := range failing {
+		if _, err := applyPatch(jsonPatchType, []byte(c[0]), []byte(c[1])); err == nil {
+			t.Error("Invalid JSON patch applied", c)
+		}
+	}
+}
+
+func TestHandlePatch(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"item"}, true, "", nil, time.Time{})
+	res.SetValue("application/json", []byte(`{"a":1,"b":{"c":2}}`))
+	text, _ := db.CreateResource([]string{"text"}, true, "", nil, time.Time{})
+	text.SetValue("text/plain", []byte("bla"))
+
+	hd := createHandlerData(t, db, "PATCH", "http://localhost:8080/asdf/qwer/item", strings.NewReader(`{"b":{"c":null,"d":3}}`))
+	hd.R.Header.Set("Content-Type", mergePatchType)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Merge patch: 200 not working")
+	ct, value, _ := res.GetValue()
+	checkJSON(t, value, []byte(`{"a":1,"b":{"d":3}}`), "Merge patch: value not patched")
+	if ct != "application/json" {
+		t.Error("Merge patch: content type changed", ct)
+	}
+	if version, _ := res.Version(); hd.W.Header().Get("ETag") != etag(version) {
+		t.Error("Merge patch: ETag not set", hd.W.Header().Get("ETag"))
+	}
+
+	hd = createHandlerData(t, db, "PATCH", "http://localhost:8080/asdf/qwer/item", strings.NewReader(`[{"op":"replace","path":"/a","value":5}]`))
+	hd.R.Header.Set("Content-Type", jsonPatchType)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "JSON patch: 200 not working")
+	_, value, _ = res.GetValue()
+	checkJSON(t, value, []byte(`{"a":5,"b":{"d":3}}`), "JSON patch: value not patched")
+
+	hd = createHandlerData(t, db, "PATCH", "http://localhost:8080/asdf/qwer/item", strings.NewReader(`[{"op":"test","path":"/a","value":1}]`))
+	hd.R.Header.Set("Content-Type", jsonPatchType)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusConflict, "JSON patch test: 409 not working")
+
+	hd = createHandlerData(t, db, "PATCH", "http://localhost:8080/asdf/qwer/item", strings.NewReader(`[{"op":"remove","path":"/x"}]`))
+	hd.R.Header.Set("Content-Type", jsonPatchType)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusUnprocessableEntity, "JSON patch: 422 not working")
+
+	hd = createHandlerData(t, db, "PATCH", "http://localhost:8080/asdf/qwer/item", strings.NewReader(`{"op":"remove"}`))
+	hd.R.Header.Set("Content-Type", jsonPatchType)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusBadRequest, "JSON patch: 400 not working")
+
+	hd = createHandlerData(t, db, "PATCH", "http://localhost:8080/asdf/qwer/item", strings.NewReader(`{"a":1}`))
+	hd.R.Header.Set("Content-Type", "application/json")
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusUnsupportedMediaType, "Patch: 415 not working")
+	if hd.W.Header().Get("Accept-Patch") == "" {
+		t.Error("Patch: Accept-Patch not set")
+	}
+
+	hd = createHandlerData(t, db, "PATCH", "http://localhost:8080/asdf/qwer/item", strings.NewReader(`{"a":1}`))
+	hd.R.Header.Set("Content-Type", mergePatchType)
+	hd.R.Header.Set("If-Match", `"0"`)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusPreconditionFailed, "Patch: 412 not working")
+
+	hd = createHandlerData(t, db, "PATCH", "http://localhost:8080/asdf/qwer/text", strings.NewReader(`{"a":1}`))
+	hd.R.Header.Set("Content-Type", mergePatchType)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusConflict, "Patch non-JSON item: 409 not working")
+	teardownDB(db)
+}
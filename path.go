@@ -46,9 +46,8 @@ func disectPath(basePath string, newPath string) ([]string, []string, error) {
 }
 
 // checks if the given name is a command
-// currently only knows about _hooks
 func isCommand(name string) bool {
-	for _, cmd := range []string{"_hooks", "_forward"} {
+	for _, cmd := range []string{"_hooks", "_forward", "_ttl", "_history", "_events", "_ws", "_metrics"} {
 		if strings.Compare(name, cmd) == 0 {
 			return true
 		}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"mime"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// maximal size of a value embedded in an event, larger values are omitted
+const maxEventValueSize = 64 * 1024
+
+// the value of an item embedded in a hook event
+type EventValue struct {
+	ContentType string          `json:"contentType"`
+	Size        int             `json:"size"`               // in bytes
+	Encoding    string          `json:"encoding,omitempty"` // json, text or base64
+	Data        json.RawMessage `json:"data,omitempty"`     // missing if the value is omitted
+	Omitted     bool            `json:"omitted,omitempty"`  // set if the value is too large to be embedded
+}
+
+// the value of an item at the time of a modification
+type itemValue struct {
+	contentType string
+	data        []byte
+}
+
+// returns the value to embed in an event
+// JSON values are embedded as they are, text as a string and anything else base64 encoded
+func (v *itemValue) embed() *EventValue {
+	ev := &EventValue{ContentType: v.contentType, Size: len(v.data)}
+	if len(v.data) > maxEventValueSize {
+		ev.Omitted = true
+		return ev
+	}
+	if isJSONType(v.contentType) && json.Valid(v.data) {
+		ev.Encoding = "json"
+		ev.Data = v.data
+		return ev
+	}
+	var data []byte
+	if isTextType(v.contentType) && utf8.Valid(v.data) {
+		ev.Encoding = "text"
+		data, _ = json.Marshal(string(v.data))
+	} else {
+		ev.Encoding = "base64"
+		data, _ = json.Marshal(base64.StdEncoding.EncodeToString(v.data))
+	}
+	ev.Data = data
+	return ev
+}
+
+// checks if the content type denotes text
+func isTextType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+xml") ||
+		mediaType == "application/xml" || mediaType == "application/javascript"
+}
+
+// functions available in body templates
+var bodyTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// parses the body template of a hook
+func parseBodyTemplate(text string) (*template.Template, error) {
+	return template.New("body").Funcs(bodyTemplateFuncs).Parse(text)
+}
+
+// returns the value of an embedded value in a template: JSON decoded, text and base64 as a string
+func templateValue(ev *EventValue) interface{} {
+	if ev == nil || ev.Omitted {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(ev.Data, &value); err != nil {
+		return nil
+	}
+	return value
+}
+
+// renders the body of an event with the template of a hook
+// the template gets the fields name, method, path, item, command, value and previous of the event
+func renderBody(text string, event HookEvent) ([]byte, error) {
+	t, err := parseBodyTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	err = t.Execute(&body, map[string]interface{}{
+		"name":     event.Name,
+		"method":   event.Method,
+		"path":     event.ModifiedResource,
+		"item":     event.Item,
+		"command":  event.Command,
+		"value":    templateValue(event.Value),
+		"previous": templateValue(event.Previous),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmbedValue(t *testing.T) {
+	tests := []struct {
+		contentType string
+		data        []byte
+		encoding    string
+		embedded    string
+	}{
+		{"application/json", []byte(`{"a": 1}`), "json", `{"a": 1}`},
+		{"application/json", []byte(`{"a": `), "base64", `"eyJhIjog"`},
+		{"text/plain; charset=utf-8", []byte("bla"), "text", `"bla"`},
+		{"application/octet-stream", []byte{0, 1, 2}, "base64", `"AAEC"`},
+	}
+	for _, test := range tests {
+		ev := (&itemValue{test.contentType, test.data}).embed()
+		if ev.Encoding != test.encoding || string(ev.Data) != test.embedded || ev.Size != len(test.data) || ev.Omitted {
+			t.Error("Value not embedded", test.contentType, ev.Encoding, string(ev.Data))
+		}
+	}
+	ev := (&itemValue{"text/plain", bytes.Repeat([]byte("a"), maxEventValueSize+1)}).embed()
+	if !ev.Omitted || ev.Data != nil || ev.Size != maxEventValueSize+1 {
+		t.Error("Large value not omitted", ev.Omitted, ev.Size)
+	}
+}
+
+func TestHookEventPayload(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"payload"}, true, "", nil, time.Time{})
+	res.SetValue("application/json", []byte(`{"a": 1}`))
+	res.AddHook([]byte(`{"name": "plain", "url": "http://test.com/plain"}`))
+	res.AddHook([]byte(`{"name": "values", "url": "http://test.com/values", "includeValue": true, "includePrevious": true}`))
+	lastEvent := func(id string) HookEvent {
+		deliveries, _ := db.GetDeliveries(hookQueue(res.GetElts(), id))
+		var event HookEvent
+		if len(deliveries) > 0 {
+			json.Unmarshal(deliveries[len(deliveries)-1].Payload, &event)
+		}
+		return event
+	}
+
+	hd := createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/payload", strings.NewReader(`{"a": 2}`))
+	hd.R.Header.Set("Content-Type", "application/json")
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Put: 200 not working")
+	if event := lastEvent("0"); event.Value != nil || event.Previous != nil {
+		t.Error("Put: value embedded without request", event)
+	}
+	event := lastEvent("1")
+	if event.Value == nil || string(event.Value.Data) != `{"a":2}` || event.Value.ContentType != "application/json" {
+		t.Error("Put: value not embedded", event.Value)
+	}
+	if event.Previous == nil || string(event.Previous.Data) != `{"a":1}` {
+		t.Error("Put: previous value not embedded", event.Previous)
+	}
+
+	hd = createHandlerData(t, db, "DELETE", "http://localhost:8080/asdf/qwer/payload", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Delete: 200 not working")
+	event = lastEvent("1")
+	if event.Method != "DELETE" || event.Value != nil || event.Previous == nil || string(event.Previous.Data) != `{"a":2}` {
+		t.Error("Delete: previous value not embedded", event)
+	}
+	teardownDB(db)
+}
+
+func TestRenderBody(t *testing.T) {
+	event := HookEvent{Name: "chat", Method: "PUT", Item: true, ModifiedResource: "/my/item",
+		Value: (&itemValue{"application/json", []byte(`{"a": 2}`)}).embed()}
+	body, err := renderBody(`{"text": {{json (printf "%s %s by %s" .method .path .name)}}, "a": {{.value.a}}, "value": {{json .value}}}`, event)
+	if err != nil || string(body) != `{"text": "PUT /my/item by chat", "a": 2, "value": {"a":2}}` {
+		t.Error("Render body not working", string(body), err)
+	}
+	event.Value = (&itemValue{"text/plain", []byte("bla")}).embed()
+	body, err = renderBody(`{{.value}} {{.item}}`, event)
+	if err != nil || string(body) != "bla true" {
+		t.Error("Render text value not working", string(body), err)
+	}
+}
+
+func TestHookHeadersAndTemplate(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"templated"}, true, "", nil, time.Time{})
+	res.AddHook([]byte(`{"name": "chat", "url": "http://test.com/chat", "secret": "s", "headers": {"authorization": "Bearer t", "Content-Type": "text/plain"}, "template": "{{.method}} {{.path}}"}`))
+
+	callHooks(db, res, "PUT", "/")
+	deliveries, _ := db.GetDeliveries(hookQueue(res.GetElts(), "0"))
+	if len(deliveries) != 1 {
+		t.Fatal("Event not queued", deliveries)
+	}
+	hook, _ := res.GetHook("0")
+	d, _ := newHookPost(hook, deliveries)
+	if string(d.Payload) != "PUT /templated" || d.Headers["Authorization"] != "Bearer t" || d.Headers["Content-Type"] != "text/plain" ||
+		d.Headers[hookSignatureHeader] != signPayload("s", d.Payload) {
+		t.Error("Templated event not working", string(d.Payload), d.Headers)
+	}
+
+	// the header values are not returned
+	for _, path := range []string{"_hooks/0", "_hooks/0/queue"} {
+		hd := createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/templated/"+path, nil)
+		handleRequest(hd)
+		if body := hd.W.(*httptest.ResponseRecorder).Body.String(); strings.Contains(body, "Bearer") {
+			t.Error("Header value returned", path, body)
+		}
+	}
+	data := `{"name": "chat", "url": "http://test.com/chat", "headers": {"Authorization": "[redacted]", "X-New": "[redacted]"}}`
+	hd := createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/templated/_hooks/0", strings.NewReader(data))
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Put hook: 200 not working")
+	if hook, _ = res.GetHook("0"); len(hook.Headers) != 1 || hook.Headers["Authorization"] != "Bearer t" {
+		t.Error("Redacted header not kept", hook.Headers)
+	}
+	teardownDB(db)
+}
@@ -0,0 +1,1045 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RecordDB implements GoBusDB on top of a simple key/record store
+// every resource is kept as one record, keyed like the redis keys
+// the delivery queues of the hooks are kept in records of their own
+type RecordDB struct {
+	store recordStore
+}
+
+type RecordResource struct {
+	db   *RecordDB
+	elts []string
+	key  string
+}
+
+// all data of a single resource
+type resourceRecord struct {
+	Name                string             `json:"name"`
+	Item                bool               `json:"item"`
+	Value               []byte             `json:"value"`
+	ContentType         string             `json:"contentType"`
+	NextID              int64              `json:"nextID"`
+	NextHookID          int64              `json:"nextHookID"`
+	Forward             string             `json:"forward"`
+	Version             int64              `json:"version"`
+	Expires             int64              `json:"expires"` // unix time in ms, 0 if the resource does not expire
+	HistoryDepth        int                `json:"historyDepth"`
+	History             []*Revision        `json:"history"` // newest revision first
+	Children            map[string]bool    `json:"children"`
+	Hooks               map[string]string  `json:"hooks"`
+	Expiring            map[string]int64   `json:"expiring,omitempty"`            // only on the expiry index: path of expiring resources -> expires
+	Due                 map[string]int64   `json:"due,omitempty"`                 // only on the delivery index: delivery queue -> next attempt
+	NextDelivery        int64              `json:"nextDelivery,omitempty"`        // only on the delivery index
+	Deliveries          []*Delivery        `json:"deliveries,omitempty"`          // only on delivery queues
+	DeadLetters         []*Delivery        `json:"deadLetters,omitempty"`         // only on delivery queues
+	DeliveryLog         []*DeliveryAttempt `json:"deliveryLog,omitempty"`         // only on delivery queues, newest first
+	Successes           int64              `json:"successes,omitempty"`           // only on delivery queues
+	Failures            int64              `json:"failures,omitempty"`            // only on delivery queues
+	ConsecutiveFailures int64              `json:"consecutiveFailures,omitempty"` // only on delivery queues
+}
+
+// a store holding resource records
+// changes done in update are only visible if f returns nil
+type recordStore interface {
+	update(f func(tx recordTx) error) error
+	view(f func(tx recordTx) error) error
+}
+
+// access to the records within a transaction
+// get returns nil if the record does not exist
+type recordTx interface {
+	get(key string) (*resourceRecord, error)
+	put(key string, rec *resourceRecord) error
+	delete(key string) error
+}
+
+const rootKey = "root"
+
+// the indexes are kept in records of their own
+// so that scheduling does not rewrite the root record with all its children
+const (
+	expiryIndexKey   = "index:expiring"
+	deliveryIndexKey = "index:deliveries"
+)
+
+func newRecord(name string, item bool) *resourceRecord {
+	return &resourceRecord{
+		Name:     name,
+		Item:     item,
+		Value:    []byte{},
+		Forward:  "{}",
+		Children: map[string]bool{},
+		Hooks:    map[string]string{},
+	}
+}
+
+// returns a deep copy of the record
+func (rec *resourceRecord) clone() *resourceRecord {
+	c := *rec
+	c.Value = append([]byte{}, rec.Value...)
+	c.Children = map[string]bool{}
+	for k, v := range rec.Children {
+		c.Children[k] = v
+	}
+	c.Hooks = map[string]string{}
+	for k, v := range rec.Hooks {
+		c.Hooks[k] = v
+	}
+	c.History = append([]*Revision{}, rec.History...) // revisions are never modified
+	if rec.Expiring != nil {
+		c.Expiring = map[string]int64{}
+		for k, v := range rec.Expiring {
+			c.Expiring[k] = v
+		}
+	}
+	if rec.Due != nil {
+		c.Due = map[string]int64{}
+		for k, v := range rec.Due {
+			c.Due[k] = v
+		}
+	}
+	c.Deliveries = copyDeliveries(rec.Deliveries)
+	c.DeadLetters = copyDeliveries(rec.DeadLetters)
+	if rec.DeliveryLog != nil {
+		c.DeliveryLog = append([]*DeliveryAttempt{}, rec.DeliveryLog...) // attempts are never modified
+	}
+	return &c
+}
+
+// returns a copy of the deliveries, the payloads and headers are shared as they are never modified
+func copyDeliveries(deliveries []*Delivery) []*Delivery {
+	if deliveries == nil {
+		return nil
+	}
+	c := make([]*Delivery, len(deliveries))
+	for i, d := range deliveries {
+		dc := *d
+		c[i] = &dc
+	}
+	return c
+}
+
+// creates a RecordDB on the given store, the root resource is created if missing
+func newRecordDB(store recordStore) (*RecordDB, error) {
+	err := store.update(func(tx recordTx) error {
+		root, err := tx.get(rootKey)
+		if err != nil || root != nil {
+			return err
+		}
+		return tx.put(rootKey, newRecord("", false))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &RecordDB{store}, nil
+}
+
+// releases the store if it holds any resources (e.g. files)
+func (db *RecordDB) Close() error {
+	if closer, ok := db.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// returns the record for key, fails if it does not exist
+func getRecord(tx recordTx, key string) (*resourceRecord, error) {
+	rec, err := tx.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		return nil, errors.New(fmt.Sprintf("Resource not found: %s", key))
+	}
+	return rec, nil
+}
+
+// returns the index record for key, an empty one if it does not exist yet
+func getIndex(tx recordTx, key string) (*resourceRecord, error) {
+	index, err := tx.get(key)
+	if err != nil || index != nil {
+		return index, err
+	}
+	return newRecord("", false), nil
+}
+
+// returns the key of the resource identified by elts
+func recordKey(elts []string) (string, error) {
+	if len(elts) == 0 {
+		return rootKey, nil
+	}
+	key, _, _, err := mkKeys(rootKey, elts)
+	return key, err
+}
+
+// creates a record and registers it with its parent
+// the parent has to exist
+func addRecord(tx recordTx, elts []string, rec *resourceRecord) error {
+	key, err := recordKey(elts)
+	if err != nil {
+		return err
+	}
+	parentKey, err := recordKey(elts[:len(elts)-1])
+	if err != nil {
+		return err
+	}
+	parent, err := getRecord(tx, parentKey)
+	if err != nil {
+		return err
+	}
+	parent.Children[key] = true
+	parent.Version++
+	err = tx.put(parentKey, parent)
+	if err != nil {
+		return err
+	}
+	rec.Version = initialVersion()
+	return tx.put(key, rec)
+}
+
+// Creates the resource defined by the given path
+// Missing intermediate resources are automatically created
+// The item flag, the content type, the value and the expiry are set on the last resource
+// If the resource exists already, errResourceExists is returned
+func (db *RecordDB) CreateResource(elts []string, item bool, contentType string, value []byte, expires time.Time) (Resource, error) {
+	if len(elts) == 0 {
+		return nil, errors.New("Can not create root resource")
+	}
+	key, err := recordKey(elts)
+	if err != nil {
+		return nil, err
+	}
+	err = db.store.update(func(tx recordTx) error {
+		for i := range elts[:len(elts)-1] {
+			k, err := recordKey(elts[:i+1])
+			if err != nil {
+				return err
+			}
+			rec, err := tx.get(k)
+			if err != nil {
+				return err
+			}
+			if rec != nil {
+				continue
+			}
+			err = addRecord(tx, elts[:i+1], newRecord(elts[i], false))
+			if err != nil {
+				return err
+			}
+		}
+		rec, err := tx.get(key)
+		if err != nil {
+			return err
+		}
+		if rec != nil {
+			return errResourceExists
+		}
+		rec = newRecord(elts[len(elts)-1], item)
+		rec.ContentType = contentType
+		rec.Value = append([]byte{}, value...)
+		rec.Expires = expiryMillis(expires)
+		err = addRecord(tx, elts, rec)
+		if err != nil || rec.Expires == 0 {
+			return err
+		}
+		return setExpiring(tx, elts, rec.Expires)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &RecordResource{db, elts, key}, nil
+}
+
+// checks to see if the resource exists
+func (db *RecordDB) ResourceExists(elts []string) (bool, error) {
+	key, _, _, err := mkKeys(rootKey, elts)
+	if err != nil {
+		return false, err
+	}
+	exists := false
+	err = db.store.view(func(tx recordTx) error {
+		rec, err := tx.get(key)
+		exists = rec != nil
+		return err
+	})
+	return exists, err
+}
+
+// searches the resource identified by the given path and returns it
+// if the Resource could not be found returns an error
+func (db *RecordDB) GetResource(elts []string) (Resource, error) {
+	key, err := recordKey(elts)
+	if err != nil {
+		return nil, err
+	}
+	err = db.store.view(func(tx recordTx) error {
+		_, err := getRecord(tx, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &RecordResource{db, elts, key}, nil
+}
+
+// runs f on the record of the resource without modifying it
+func (r *RecordResource) view(f func(rec *resourceRecord) error) error {
+	return r.db.store.view(func(tx recordTx) error {
+		rec, err := getRecord(tx, r.key)
+		if err != nil {
+			return err
+		}
+		return f(rec)
+	})
+}
+
+// runs f on the record of the resource and stores the modified record
+func (r *RecordResource) update(f func(rec *resourceRecord) error) error {
+	return r.db.store.update(func(tx recordTx) error {
+		rec, err := getRecord(tx, r.key)
+		if err != nil {
+			return err
+		}
+		err = f(rec)
+		if err != nil {
+			return err
+		}
+		return tx.put(r.key, rec)
+	})
+}
+
+// deletes a resource
+// delete non-leaf resources generates an error
+func (r *RecordResource) Delete() error {
+	return r.DeleteIfVersion(anyVersion)
+}
+
+// deletes a resource if its version matches
+func (r *RecordResource) DeleteIfVersion(version int64) error {
+	_, err := r.deleteIf(func(rec *resourceRecord) (bool, error) {
+		if version != anyVersion && rec.Version != version {
+			return false, errVersionMismatch
+		}
+		return true, nil
+	})
+	return err
+}
+
+// deletes a resource if it is expired at the given time, returns false if it is not expired
+func (r *RecordResource) DeleteIfExpired(now time.Time) (bool, error) {
+	return r.deleteIf(func(rec *resourceRecord) (bool, error) {
+		return rec.Expires != 0 && rec.Expires <= expiryMillis(now), nil
+	})
+}
+
+// deletes a leaf resource within a transaction if check returns true
+// returns true if the resource has been deleted
+func (r *RecordResource) deleteIf(check func(rec *resourceRecord) (bool, error)) (bool, error) {
+	if len(r.elts) == 0 {
+		return false, errors.New(fmt.Sprintf("Can not delete root resource %s", r.key))
+	}
+	deleted := false
+	err := r.db.store.update(func(tx recordTx) error {
+		rec, err := getRecord(tx, r.key)
+		if err != nil {
+			return err
+		}
+		ok, err := check(rec)
+		if err != nil || !ok {
+			return err
+		}
+		if len(rec.Children) != 0 {
+			return errors.New(fmt.Sprintf("Can not delete non-leaf resource %s", r.key))
+		}
+		parentKey, err := recordKey(r.elts[:len(r.elts)-1])
+		if err != nil {
+			return err
+		}
+		parent, err := getRecord(tx, parentKey)
+		if err != nil {
+			return err
+		}
+		delete(parent.Children, r.key)
+		parent.Version++
+		err = tx.put(parentKey, parent)
+		if err != nil {
+			return err
+		}
+		if rec.Expires != 0 {
+			err = setExpiring(tx, r.elts, 0)
+			if err != nil {
+				return err
+			}
+		}
+		deleted = true
+		return tx.delete(r.key)
+	})
+	return deleted && err == nil, err
+}
+
+// registers the expiry of a resource in the expiry index, 0 removes it
+func setExpiring(tx recordTx, elts []string, expires int64) error {
+	index, err := getIndex(tx, expiryIndexKey)
+	if err != nil {
+		return err
+	}
+	if index.Expiring == nil {
+		index.Expiring = map[string]int64{}
+	}
+	path := strings.Join(elts, "/")
+	if expires == 0 {
+		delete(index.Expiring, path)
+	} else {
+		index.Expiring[path] = expires
+	}
+	return tx.put(expiryIndexKey, index)
+}
+
+// returns the paths of all resources expired at the given time
+func (db *RecordDB) ExpiredResources(now time.Time) ([][]string, error) {
+	expired := [][]string{}
+	err := db.store.view(func(tx recordTx) error {
+		index, err := getIndex(tx, expiryIndexKey)
+		if err != nil {
+			return err
+		}
+		for path, expires := range index.Expiring {
+			if expires <= expiryMillis(now) {
+				expired = append(expired, strings.Split(path, "/"))
+			}
+		}
+		return nil
+	})
+	return expired, err
+}
+
+// returns the time the resource expires, the zero time if it does not expire
+func (r *RecordResource) GetExpiry() (time.Time, error) {
+	var expires int64
+	err := r.view(func(rec *resourceRecord) error {
+		expires = rec.Expires
+		return nil
+	})
+	return millisExpiry(expires), err
+}
+
+// sets the time the resource expires, the zero time removes the expiry
+func (r *RecordResource) SetExpiry(expires time.Time) error {
+	if len(r.elts) == 0 {
+		return errors.New("Root resource can not expire")
+	}
+	return r.db.store.update(func(tx recordTx) error {
+		rec, err := getRecord(tx, r.key)
+		if err != nil {
+			return err
+		}
+		rec.Expires = expiryMillis(expires)
+		err = tx.put(r.key, rec)
+		if err != nil {
+			return err
+		}
+		return setExpiring(tx, r.elts, rec.Expires)
+	})
+}
+
+func (r *RecordResource) Name() (string, error) {
+	var name string
+	err := r.view(func(rec *resourceRecord) error {
+		name = rec.Name
+		return nil
+	})
+	return name, err
+}
+
+func (r *RecordResource) IsItem() (bool, error) {
+	var item bool
+	err := r.view(func(rec *resourceRecord) error {
+		item = rec.Item
+		return nil
+	})
+	return item, err
+}
+
+func (r *RecordResource) GetElts() []string {
+	return r.elts
+}
+
+// returns the content-type and the value of a resource
+func (r *RecordResource) GetValue() (string, []byte, error) {
+	var contentType string
+	var value []byte
+	err := r.view(func(rec *resourceRecord) error {
+		contentType, value = rec.ContentType, rec.Value
+		return nil
+	})
+	return contentType, value, err
+}
+
+// returns the version of the resource
+// the version changes on every change of the value or the children
+func (r *RecordResource) Version() (int64, error) {
+	var version int64
+	err := r.view(func(rec *resourceRecord) error {
+		version = rec.Version
+		return nil
+	})
+	return version, err
+}
+
+func (r *RecordResource) SetValue(contentType string, value []byte) error {
+	_, err := r.SetValueIfVersion(contentType, value, anyVersion, time.Time{})
+	return err
+}
+
+// sets the value if the version matches, returns the new version
+// the expiry is set together with the value, the zero time keeps the current expiry
+func (r *RecordResource) SetValueIfVersion(contentType string, value []byte, version int64, expires time.Time) (int64, error) {
+	if len(r.elts) == 0 && !expires.IsZero() {
+		return 0, errors.New("Root resource can not expire")
+	}
+	var newVersion int64
+	err := r.db.store.update(func(tx recordTx) error {
+		rec, err := getRecord(tx, r.key)
+		if err != nil {
+			return err
+		}
+		if version != anyVersion && rec.Version != version {
+			return errVersionMismatch
+		}
+		rec.ContentType = contentType
+		rec.Value = append([]byte{}, value...)
+		rec.Version++
+		newVersion = rec.Version
+		if rec.HistoryDepth > 0 {
+			revision := &Revision{rec.Version, time.Now(), contentType, rec.Value}
+			rec.History = append([]*Revision{revision}, rec.History...)
+			if len(rec.History) > rec.HistoryDepth {
+				rec.History = rec.History[:rec.HistoryDepth]
+			}
+		}
+		if !expires.IsZero() {
+			rec.Expires = expiryMillis(expires)
+		}
+		err = tx.put(r.key, rec)
+		if err != nil || expires.IsZero() {
+			return err
+		}
+		return setExpiring(tx, r.elts, rec.Expires)
+	})
+	return newVersion, err
+}
+
+// returns the number of revisions kept in the history, 0 if disabled
+func (r *RecordResource) GetHistoryDepth() (int, error) {
+	var depth int
+	err := r.view(func(rec *resourceRecord) error {
+		depth = rec.HistoryDepth
+		return nil
+	})
+	return depth, err
+}
+
+// sets the number of revisions kept in the history
+// 0 disables the history and removes all revisions
+func (r *RecordResource) SetHistoryDepth(depth int) error {
+	if depth < 0 {
+		return errors.New(fmt.Sprintf("Invalid history depth %d", depth))
+	}
+	return r.update(func(rec *resourceRecord) error {
+		rec.HistoryDepth = depth
+		if len(rec.History) > depth {
+			rec.History = rec.History[:depth]
+		}
+		return nil
+	})
+}
+
+// returns all revisions in the history, newest first
+func (r *RecordResource) GetHistory() ([]*Revision, error) {
+	var revisions []*Revision
+	err := r.view(func(rec *resourceRecord) error {
+		revisions = append([]*Revision{}, rec.History...)
+		return nil
+	})
+	return revisions, err
+}
+
+// returns the revision of the given version from the history
+func (r *RecordResource) GetRevision(version int64) (*Revision, error) {
+	revisions, err := r.GetHistory()
+	if err != nil {
+		return nil, err
+	}
+	return findRevision(revisions, version)
+}
+
+// returns a list with all children's IDs
+func (r *RecordResource) GetChildren() ([]string, error) {
+	children := []string{}
+	err := r.view(func(rec *resourceRecord) error {
+		for k := range rec.Children {
+			children = append(children, k)
+		}
+		return nil
+	})
+	sort.Strings(children)
+	return children, err
+}
+
+// adds a resource to a collection
+// the resource may not be an item
+// the new resource expires at the given time, the zero time for never
+func (r *RecordResource) AddToCollection(contentType string, data []byte, expires time.Time) (string, error) {
+	var name string
+	err := r.db.store.update(func(tx recordTx) error {
+		rec, err := getRecord(tx, r.key)
+		if err != nil {
+			return err
+		}
+		if rec.Item {
+			return errors.New("Can not add to item")
+		}
+		name = strconv.FormatInt(rec.NextID, 10)
+		rec.NextID++
+		err = tx.put(r.key, rec)
+		if err != nil {
+			return err
+		}
+		child := newRecord(name, true)
+		child.ContentType = contentType
+		child.Value = append([]byte{}, data...)
+		child.Expires = expiryMillis(expires)
+		newElts := append(append([]string{}, r.elts...), name)
+		err = addRecord(tx, newElts, child)
+		if err != nil || child.Expires == 0 {
+			return err
+		}
+		return setExpiring(tx, newElts, child.Expires)
+	})
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// creates a new hook, generating a new ID for the hook
+func (r *RecordResource) AddHook(data []byte) (string, error) {
+	var id string
+	err := r.update(func(rec *resourceRecord) error {
+		id = strconv.FormatInt(rec.NextHookID, 10)
+		rec.NextHookID++
+		return setRecordHook(rec, id, data)
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// sets the value of a hook with a known ID
+func (r *RecordResource) SetHook(id string, data []byte) error {
+	return r.update(func(rec *resourceRecord) error {
+		return setRecordHook(rec, id, data)
+	})
+}
+
+func setRecordHook(rec *resourceRecord, id string, data []byte) error {
+	hook, err := parseHook(data) // check if hook parses ok
+	if err != nil {
+		return err
+	}
+	hook.Id = id // make sure hook ID is correct
+	hookData, err := json.Marshal(hook)
+	if err != nil {
+		return err
+	}
+	rec.Hooks[id] = string(hookData)
+	return nil
+}
+
+func (r *RecordResource) GetHook(id string) (*Hook, error) {
+	var hook *Hook
+	err := r.view(func(rec *resourceRecord) error {
+		data, ok := rec.Hooks[id]
+		if !ok {
+			return errors.New(fmt.Sprintf("Could not find hook with id: %s", id))
+		}
+		var err error
+		hook, err = parseHook([]byte(data))
+		return err
+	})
+	return hook, err
+}
+
+func (r *RecordResource) DeleteHook(id string) error {
+	return r.update(func(rec *resourceRecord) error {
+		if _, ok := rec.Hooks[id]; !ok {
+			return errors.New(fmt.Sprintf("Could not find hook with id: %s", id))
+		}
+		delete(rec.Hooks, id)
+		return nil
+	})
+}
+
+func (r *RecordResource) GetHooksIDs() ([]string, error) {
+	var ids []string
+	err := r.view(func(rec *resourceRecord) error {
+		ids = hookIDs(rec)
+		return nil
+	})
+	return ids, err
+}
+
+func (r *RecordResource) GetHooks() ([]*Hook, error) {
+	hooks := []*Hook{}
+	err := r.view(func(rec *resourceRecord) error {
+		for _, id := range hookIDs(rec) {
+			hook, err := parseHook([]byte(rec.Hooks[id]))
+			if err != nil {
+				return err
+			}
+			hooks = append(hooks, hook)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// returns the sorted IDs of all hooks of a record
+func hookIDs(rec *resourceRecord) []string {
+	ids := []string{}
+	for id := range rec.Hooks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (r *RecordResource) GetForward() (*Forward, error) {
+	var forward string
+	err := r.view(func(rec *resourceRecord) error {
+		forward = rec.Forward
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseForward([]byte(forward))
+}
+
+// sets the value of the forward
+func (r *RecordResource) AddForward(data []byte) error {
+	forward, err := parseForward(data) // check if forward parses ok
+	if err != nil {
+		return err
+	}
+	forwardData, err := json.Marshal(forward)
+	if err != nil {
+		return err
+	}
+	return r.update(func(rec *resourceRecord) error {
+		rec.Forward = string(forwardData)
+		return nil
+	})
+}
+
+func (r *RecordResource) DeleteForward() error {
+	return r.update(func(rec *resourceRecord) error {
+		rec.Forward = "{}"
+		return nil
+	})
+}
+
+// returns the key of the record holding a delivery queue
+func queueKey(queue string) string {
+	return "queue:" + queue
+}
+
+// returns the record of a delivery queue, an empty one if it does not exist
+func getQueueRecord(tx recordTx, queue string) (*resourceRecord, error) {
+	rec, err := tx.get(queueKey(queue))
+	if err != nil || rec != nil {
+		return rec, err
+	}
+	return newRecord(queue, false), nil
+}
+
+// stores the record of a delivery queue and schedules the queue for its head
+// empty queues are removed
+func putQueueRecord(tx recordTx, queue string, rec *resourceRecord) error {
+	index, err := getIndex(tx, deliveryIndexKey)
+	if err != nil {
+		return err
+	}
+	if index.Due == nil {
+		index.Due = map[string]int64{}
+	}
+	if len(rec.Deliveries) == 0 {
+		delete(index.Due, queue)
+	} else {
+		index.Due[queue] = expiryMillis(queueDue(rec.Deliveries))
+	}
+	err = tx.put(deliveryIndexKey, index)
+	if err != nil {
+		return err
+	}
+	if len(rec.Deliveries) == 0 && len(rec.DeadLetters) == 0 && len(rec.DeliveryLog) == 0 {
+		return tx.delete(queueKey(queue))
+	}
+	return tx.put(queueKey(queue), rec)
+}
+
+// changes a delivery queue within a transaction
+func (db *RecordDB) updateQueue(queue string, f func(rec *resourceRecord) error) error {
+	return db.store.update(func(tx recordTx) error {
+		rec, err := getQueueRecord(tx, queue)
+		if err != nil {
+			return err
+		}
+		err = f(rec)
+		if err != nil {
+			return err
+		}
+		return putQueueRecord(tx, queue, rec)
+	})
+}
+
+// reads a delivery queue within a transaction
+func (db *RecordDB) viewQueue(queue string, f func(rec *resourceRecord) error) error {
+	return db.store.view(func(tx recordTx) error {
+		rec, err := getQueueRecord(tx, queue)
+		if err != nil {
+			return err
+		}
+		return f(rec)
+	})
+}
+
+// appends a delivery to the queue, the ID of the delivery is set
+func (db *RecordDB) EnqueueDelivery(queue string, d *Delivery) error {
+	return db.store.update(func(tx recordTx) error {
+		index, err := getIndex(tx, deliveryIndexKey)
+		if err != nil {
+			return err
+		}
+		d.ID = strconv.FormatInt(index.NextDelivery, 10)
+		index.NextDelivery++
+		err = tx.put(deliveryIndexKey, index)
+		if err != nil {
+			return err
+		}
+		rec, err := getQueueRecord(tx, queue)
+		if err != nil {
+			return err
+		}
+		c := *d
+		rec.Deliveries = append(rec.Deliveries, &c)
+		return putQueueRecord(tx, queue, rec)
+	})
+}
+
+// returns the queues whose head is due
+func (db *RecordDB) DueQueues(now time.Time) ([]string, error) {
+	queues := []string{}
+	err := db.store.view(func(tx recordTx) error {
+		index, err := getIndex(tx, deliveryIndexKey)
+		if err != nil {
+			return err
+		}
+		for queue, next := range index.Due {
+			if next <= expiryMillis(now) {
+				queues = append(queues, queue)
+			}
+		}
+		return nil
+	})
+	sort.Strings(queues)
+	return queues, err
+}
+
+// takes the lease of a queue, always granted
+// a record store is used by a single process, whose dispatcher does not deliver a queue twice at once
+func (db *RecordDB) LeaseQueue(queue, owner string, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+// releases the lease of a queue
+func (db *RecordDB) ReleaseQueue(queue, owner string) error {
+	return nil
+}
+
+// returns the number of deliveries of all queues which are not empty
+func (db *RecordDB) QueueDepths() (map[string]int, error) {
+	depths := map[string]int{}
+	err := db.store.view(func(tx recordTx) error {
+		index, err := getIndex(tx, deliveryIndexKey)
+		if err != nil {
+			return err
+		}
+		for queue := range index.Due {
+			rec, err := getQueueRecord(tx, queue)
+			if err != nil {
+				return err
+			}
+			depths[queue] = len(rec.Deliveries)
+		}
+		return nil
+	})
+	return depths, err
+}
+
+// returns the deliveries of a queue, the head first
+func (db *RecordDB) GetDeliveries(queue string) ([]*Delivery, error) {
+	var deliveries []*Delivery
+	err := db.viewQueue(queue, func(rec *resourceRecord) error {
+		deliveries = rec.Deliveries
+		return nil
+	})
+	return deliveries, err
+}
+
+// stores the failed attempt of the head of the queue and schedules the queue for the next attempt
+func (db *RecordDB) RetryDelivery(queue string, d *Delivery) error {
+	return db.updateQueue(queue, func(rec *resourceRecord) error {
+		if len(rec.Deliveries) == 0 || rec.Deliveries[0].ID != d.ID {
+			return errDeliveryNotFound
+		}
+		c := *d
+		rec.Deliveries[0] = &c
+		return nil
+	})
+}
+
+// removes the head of the queue, it is added to the dead letters if dead is set
+func (db *RecordDB) FinishDelivery(queue string, d *Delivery, dead bool) error {
+	return db.updateQueue(queue, func(rec *resourceRecord) error {
+		if len(rec.Deliveries) == 0 || rec.Deliveries[0].ID != d.ID {
+			return errDeliveryNotFound
+		}
+		rec.Deliveries = rec.Deliveries[1:]
+		if dead {
+			c := *d
+			rec.DeadLetters = append(rec.DeadLetters, &c)
+			if len(rec.DeadLetters) > maxDeadLetters {
+				rec.DeadLetters = rec.DeadLetters[len(rec.DeadLetters)-maxDeadLetters:]
+			}
+		}
+		return nil
+	})
+}
+
+// returns the dead letters of a queue, the oldest first
+func (db *RecordDB) GetDeadLetters(queue string) ([]*Delivery, error) {
+	var deadLetters []*Delivery
+	err := db.viewQueue(queue, func(rec *resourceRecord) error {
+		deadLetters = rec.DeadLetters
+		return nil
+	})
+	return deadLetters, err
+}
+
+// removes a dead letter and returns it
+func removeDeadLetter(rec *resourceRecord, id string) (*Delivery, error) {
+	for i, d := range rec.DeadLetters {
+		if d.ID == id {
+			rec.DeadLetters = append(rec.DeadLetters[:i:i], rec.DeadLetters[i+1:]...)
+			return d, nil
+		}
+	}
+	return nil, errDeliveryNotFound
+}
+
+// moves a dead letter back to the end of the queue, its attempts are reset
+func (db *RecordDB) ReplayDeadLetter(queue, id string) error {
+	return db.updateQueue(queue, func(rec *resourceRecord) error {
+		d, err := removeDeadLetter(rec, id)
+		if err != nil {
+			return err
+		}
+		rec.Deliveries = append(rec.Deliveries, replayedDelivery(d))
+		return nil
+	})
+}
+
+// drops a dead letter
+func (db *RecordDB) DeleteDeadLetter(queue, id string) error {
+	return db.updateQueue(queue, func(rec *resourceRecord) error {
+		_, err := removeDeadLetter(rec, id)
+		return err
+	})
+}
+
+// drops all pending deliveries, dead letters and the delivery log of a queue
+func (db *RecordDB) DeleteDeliveries(queue string) error {
+	return db.updateQueue(queue, func(rec *resourceRecord) error {
+		rec.Deliveries = nil
+		rec.DeadLetters = nil
+		rec.DeliveryLog = nil
+		rec.Successes = 0
+		rec.Failures = 0
+		rec.ConsecutiveFailures = 0
+		return nil
+	})
+}
+
+// logs an attempt to deliver an event of the queue and counts it
+func (db *RecordDB) LogDeliveryAttempt(queue string, a *DeliveryAttempt) error {
+	return db.updateQueue(queue, func(rec *resourceRecord) error {
+		c := *a
+		rec.DeliveryLog = append([]*DeliveryAttempt{&c}, rec.DeliveryLog...)
+		if len(rec.DeliveryLog) > maxDeliveryLog {
+			rec.DeliveryLog = rec.DeliveryLog[:maxDeliveryLog]
+		}
+		if a.Error == "" {
+			rec.Successes++
+			rec.ConsecutiveFailures = 0
+		} else {
+			rec.Failures++
+			rec.ConsecutiveFailures++
+		}
+		return nil
+	})
+}
+
+// returns the latest delivery attempts of a queue, the newest first
+func (db *RecordDB) GetDeliveryLog(queue string) ([]*DeliveryAttempt, error) {
+	attempts := []*DeliveryAttempt{}
+	err := db.viewQueue(queue, func(rec *resourceRecord) error {
+		attempts = append(attempts, rec.DeliveryLog...)
+		return nil
+	})
+	return attempts, err
+}
+
+// returns the counters of the delivery attempts of a queue
+func (db *RecordDB) GetDeliveryStats(queue string) (*DeliveryStats, error) {
+	var stats DeliveryStats
+	err := db.viewQueue(queue, func(rec *resourceRecord) error {
+		stats = DeliveryStats{rec.Successes, rec.Failures, rec.ConsecutiveFailures}
+		return nil
+	})
+	return &stats, err
+}
+
+// resets the number of consecutive failures of a queue
+func (db *RecordDB) ResetDeliveryFailures(queue string) error {
+	return db.updateQueue(queue, func(rec *resourceRecord) error {
+		rec.ConsecutiveFailures = 0
+		return nil
+	})
+}
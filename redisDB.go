@@ -1,19 +1,37 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
-
-	"github.com/bsm/redis-lock"
+	"time"
 
 	"gopkg.in/redis.v3"
 )
 
 type RedisDB struct {
 	Client *redis.Client
+	root   string // key of the root resource, all other keys start with it
+}
+
+// configuration of the redis connection
+// zero values select the defaults of the redis client
+type RedisConfig struct {
+	Addr         string // host:port, default localhost:6379
+	Password     string
+	DB           int64
+	PoolSize     int
+	PoolTimeout  time.Duration
+	IdleTimeout  time.Duration
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	TLS          *tls.Config // connect using TLS if set
+	Prefix       string      // namespace for all keys, e.g. to share a redis between several gobus
 }
 
 type RedisResource struct {
@@ -23,89 +41,344 @@ type RedisResource struct {
 	childKey string
 	hookKey  string
 	forward  string
-	lock     *lock.Lock
+	lock     *redisLock
 }
 
 const (
-	nameField        = "name"
-	itemField        = "item"
-	valueField       = "value"
-	contentTypeField = "contentType"
-	nextIDField      = "nextID"
-	nextHookIDField  = "nextHookID"
-	forwardField     = "forward"
+	nameField         = "name"
+	itemField         = "item"
+	valueField        = "value"
+	contentTypeField  = "contentType"
+	nextIDField       = "nextID"
+	nextHookIDField   = "nextHookID"
+	forwardField      = "forward"
+	versionField      = "version"
+	expiresField      = "expires"
+	historyDepthField = "historyDepth"
 )
 
+// creates a RedisDB connected to the redis on localhost
 func NewRedisDB() GoBusDB {
-	client := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
+	return NewRedisDBFromConfig(RedisConfig{})
+}
 
-	return &RedisDB{client}
+// creates a RedisDB using the given connection configuration
+func NewRedisDBFromConfig(cfg RedisConfig) GoBusDB {
+	addr := cfg.Addr
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	opts := &redis.Options{
+		Addr:         addr,
+		Password:     cfg.Password,
+		DB:           cfg.DB,
+		PoolSize:     cfg.PoolSize,
+		PoolTimeout:  cfg.PoolTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+		DialTimeout:  cfg.DialTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+	}
+	if cfg.TLS != nil {
+		dialer := &net.Dialer{Timeout: cfg.DialTimeout}
+		opts.Dialer = func() (net.Conn, error) {
+			return tls.DialWithDialer(dialer, "tcp", addr, cfg.TLS)
+		}
+	}
+	root := rootKey
+	if cfg.Prefix != "" {
+		root = cfg.Prefix + ":" + rootKey
+	}
+	return &RedisDB{redis.NewClient(opts), root}
 }
 
-func mkKeys(elts []string) (string, string, string, error) {
+// returns the keys of the resource, its children and its hooks
+// root is prepended to all keys
+func mkKeys(root string, elts []string) (string, string, string, error) {
 	for _, e := range elts {
 		if isCommand(e) || strings.HasSuffix(e, "-lock") {
 			return "", "", "", errors.New(fmt.Sprintf("Path contains illegal name %s", e))
 		}
 	}
-	key := "root:" + strings.Join(elts, ":")
+	key := root + ":" + strings.Join(elts, ":")
 	childKey := key + ":_children"
 	hookKey := key + ":_hooks"
 	return key, childKey, hookKey, nil
 }
 
 func mkResource(db *RedisDB, elts []string, key, childKey, hookKey, forward string) Resource {
-	lock := lock.NewLock(db.Client, key+"-lock", nil)
+	lock := &redisLock{client: db.Client, key: key + "-lock"}
 	return &RedisResource{db, elts, key, childKey, hookKey, forward, lock}
 }
 
-func (db *RedisDB) addResource(elts []string, value, ct, item string) (Resource, error) {
-	key, childKey, hookKey, err := mkKeys(elts)
+// timing of the locks of the resources
+const (
+	lockTimeout = 5 * time.Second       // a lock which is not released expires after this time
+	lockRetry   = 10 * time.Millisecond // wait before trying again to take a held lock
+)
+
+// a lock of a resource shared by all processes using the database
+type redisLock struct {
+	client *redis.Client
+	key    string
+	token  string // tells the holder of the lock apart, set while the lock is held
+}
+
+// takes the lock for the holder
+// KEYS are the lock
+// ARGV are the token of the holder and the timeout of the lock in ms
+const lockScript = `
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 1
+end
+return 0
+`
+
+// takes the lock, waits at most lockTimeout for it to be released
+// returns false if the lock is still held by another holder
+func (l *redisLock) Lock() (bool, error) {
+	token, err := randomHex(16)
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+	args := []string{token, strconv.FormatInt(int64(lockTimeout/time.Millisecond), 10)}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		locked, err := l.client.Eval(lockScript, []string{l.key}, args).Result()
+		if err != nil {
+			return false, err
+		}
+		if locked != int64(0) {
+			l.token = token
+			return true, nil
+		}
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+		time.Sleep(lockRetry)
 	}
+}
 
-	name := elts[len(elts)-1]
-	db.Client.HSet(key, nameField, name)
-	db.Client.HSet(key, valueField, value)
-	db.Client.HSet(key, contentTypeField, ct)
-	db.Client.HSet(key, itemField, item)
-	db.Client.HSet(key, nextIDField, "0")
-	db.Client.HSet(key, nextHookIDField, "0")
-	db.Client.HSet(key, forwardField, "{}")
-	parent, err := db.GetResource(elts[:len(elts)-1])
-	if err != nil {
-		return nil, err
+// releases the lock if it is still held
+func (l *redisLock) Unlock() error {
+	if l.token == "" {
+		return nil
 	}
-	err = parent.(*RedisResource).addChildKey(key)
-	if err != nil {
-		return nil, err
+	token := l.token
+	l.token = ""
+	return l.client.Eval(releaseScript, []string{l.key}, []string{token}).Err()
+}
+
+// creates the missing resources of a path and adds them to their parents
+// KEYS are the key and child set of the root followed by the key and child set of each level
+// and the expiry set
+// ARGV are the item flag, the content type, the value, the expiry in unix ms (0 for none) and the path
+// of the last level and the initial version followed by the names of all levels
+// fails without changes if the last level exists already
+const createScript = `
+local n = #ARGV - 6
+if redis.call('EXISTS', KEYS[2*n+1]) == 1 then
+	return redis.error_reply('Resource exists already')
+end
+for i = 1, n do
+	local key = KEYS[2*i+1]
+	if redis.call('EXISTS', key) == 0 then
+		local item, contentType, value = 'false', '', ''
+		if i == n then
+			item, contentType, value = ARGV[1], ARGV[2], ARGV[3]
+		end
+		redis.call('HMSET', key, 'name', ARGV[i+6], 'value', value, 'contentType', contentType,
+			'item', item, 'nextID', '0', 'nextHookID', '0', 'forward', '{}', 'version', ARGV[6])
+		redis.call('SADD', KEYS[2*i], key)
+		redis.call('HINCRBY', KEYS[2*i-1], 'version', 1)
+	end
+end
+if ARGV[4] ~= '0' then
+	redis.call('HSET', KEYS[2*n+1], 'expires', ARGV[4])
+	redis.call('ZADD', KEYS[2*n+3], ARGV[4], ARGV[5])
+end
+return n
+`
+
+// deletes a leaf resource and removes it from its parent and the expiry set
+// KEYS are the key, child set and hook set of the resource, the key and child set of the parent,
+// the expiry set and the history of the resource
+// ARGV are the expected version of the resource (-1 for any), its path
+// and the time in unix ms it has to be expired at (empty if it does not have to be expired)
+// returns 0 without changes if the resource is not expired
+const deleteScript = `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('Resource not found: ' .. KEYS[1])
+end
+local version = tonumber(redis.call('HGET', KEYS[1], 'version') or '0')
+if tonumber(ARGV[1]) >= 0 and version ~= tonumber(ARGV[1]) then
+	return redis.error_reply('Version does not match')
+end
+if ARGV[3] ~= '' then
+	local expires = tonumber(redis.call('HGET', KEYS[1], 'expires') or '0')
+	if expires == 0 or expires > tonumber(ARGV[3]) then
+		return 0
+	end
+end
+if redis.call('SCARD', KEYS[2]) ~= 0 then
+	return redis.error_reply('Can not delete non-leaf resource ' .. KEYS[1])
+end
+redis.call('SREM', KEYS[5], KEYS[1])
+redis.call('ZREM', KEYS[6], ARGV[2])
+redis.call('HINCRBY', KEYS[4], 'version', 1)
+return redis.call('DEL', KEYS[1], KEYS[2], KEYS[3], KEYS[7])
+`
+
+// adds an item named by the next ID of a collection
+// KEYS are the key and child set of the collection and the expiry set
+// ARGV are the content type, the value, the initial version and the expiry in unix ms (0 for none)
+// of the item and the path of the collection
+// returns the name of the item, fails without changes if the collection is an item
+const addScript = `
+local item = redis.call('HGET', KEYS[1], 'item')
+if not item then
+	return redis.error_reply('Resource not found: ' .. KEYS[1])
+end
+if item ~= 'false' then
+	return redis.error_reply('Can not add to item')
+end
+local name = tostring(redis.call('HINCRBY', KEYS[1], 'nextID', 1) - 1)
+local key = KEYS[1] .. ':' .. name
+redis.call('HMSET', key, 'name', name, 'value', ARGV[2], 'contentType', ARGV[1],
+	'item', 'true', 'nextID', '0', 'nextHookID', '0', 'forward', '{}', 'version', ARGV[3])
+redis.call('SADD', KEYS[2], key)
+redis.call('HINCRBY', KEYS[1], 'version', 1)
+if ARGV[4] ~= '0' then
+	local path = name
+	if ARGV[5] ~= '' then
+		path = ARGV[5] .. '/' .. name
+	end
+	redis.call('HSET', key, 'expires', ARGV[4])
+	redis.call('ZADD', KEYS[3], ARGV[4], path)
+end
+return name
+`
+
+// sets the value of a resource and increments its version
+// the new value is added to the history if the history is enabled
+// KEYS are the key and the history of the resource and the expiry set
+// ARGV are the expected version (-1 for any), the content type, the value, the time in unix ms,
+// the expiry in unix ms (0 to keep the current one) and the path of the resource
+const setValueScript = `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('Resource not found: ' .. KEYS[1])
+end
+local version = tonumber(redis.call('HGET', KEYS[1], 'version') or '0')
+if tonumber(ARGV[1]) >= 0 and version ~= tonumber(ARGV[1]) then
+	return redis.error_reply('Version does not match')
+end
+redis.call('HMSET', KEYS[1], 'contentType', ARGV[2], 'value', ARGV[3])
+local newVersion = redis.call('HINCRBY', KEYS[1], 'version', 1)
+local depth = tonumber(redis.call('HGET', KEYS[1], 'historyDepth') or '0')
+if depth > 0 then
+	redis.call('LPUSH', KEYS[2], newVersion .. '\n' .. ARGV[4] .. '\n' .. ARGV[2] .. '\n' .. ARGV[3])
+	redis.call('LTRIM', KEYS[2], 0, depth - 1)
+end
+if ARGV[5] ~= '0' then
+	redis.call('HSET', KEYS[1], 'expires', ARGV[5])
+	redis.call('ZADD', KEYS[3], ARGV[5], ARGV[6])
+end
+return newVersion
+`
+
+// sets the expiry of a resource and registers it in the expiry set
+// KEYS are the key of the resource and the expiry set
+// ARGV are the expiry in unix ms (0 to remove it) and the path of the resource
+const setExpiryScript = `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('Resource not found: ' .. KEYS[1])
+end
+if ARGV[1] == '0' then
+	redis.call('HDEL', KEYS[1], 'expires')
+	return redis.call('ZREM', KEYS[2], ARGV[2])
+end
+redis.call('HSET', KEYS[1], 'expires', ARGV[1])
+return redis.call('ZADD', KEYS[2], ARGV[1], ARGV[2])
+`
+
+// maps errors returned by the scripts to the errors of the Resource interface
+func scriptError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch err.Error() {
+	case errVersionMismatch.Error():
+		return errVersionMismatch
+	case errResourceExists.Error():
+		return errResourceExists
+	}
+	return err
+}
+
+// returns the key of a resource and the key of the set holding its children
+// in contrast to mkKeys the root resource is supported
+func (db *RedisDB) resourceKeys(elts []string) (string, string, error) {
+	if len(elts) == 0 {
+		return db.root, db.root + ":_children", nil
 	}
-	return mkResource(db, elts, key, childKey, hookKey, "{}"), nil
+	key, childKey, _, err := mkKeys(db.root, elts)
+	return key, childKey, err
 }
 
 // Creates the resource defined by the given path
 // Missing intermediate resources are automatically created
-// The item flag is set on the last resource
-// If the resource exists already, an error is returned
-func (db *RedisDB) CreateResource(elts []string, item bool) (Resource, error) {
-	// check intermediary resources
-	for i, _ := range elts[:len(elts)-1] {
-		exists, _ := db.ResourceExists(elts[:i+1])
-		if !exists {
-			db.addResource(elts[:i+1], "", "", "false")
+// The item flag, the content type, the value and the expiry are set on the last resource
+// If the resource exists already, errResourceExists is returned
+// The resource and all intermediate resources are created atomically
+func (db *RedisDB) CreateResource(elts []string, item bool, contentType string, value []byte, expires time.Time) (Resource, error) {
+	if len(elts) == 0 {
+		return nil, errors.New("Can not create root resource")
+	}
+	rootKey, rootChildKey, _ := db.resourceKeys([]string{})
+	keys := []string{rootKey, rootChildKey}
+	args := []string{strconv.FormatBool(item), contentType, string(value),
+		strconv.FormatInt(expiryMillis(expires), 10), strings.Join(elts, "/"), strconv.FormatInt(initialVersion(), 10)}
+	for i := range elts {
+		key, childKey, _, err := mkKeys(db.root, elts[:i+1])
+		if err != nil {
+			return nil, err
 		}
+		keys = append(keys, key, childKey)
+		args = append(args, elts[i])
+	}
+	keys = append(keys, db.expiryKey())
+	err := db.Client.Eval(createScript, keys, args).Err()
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	return db.GetResource(elts)
+}
+
+// returns the key of the sorted set holding the paths of all expiring resources
+// resource keys always continue the root with ":", so this can not collide
+func (db *RedisDB) expiryKey() string {
+	return db.root + "-expiry"
+}
+
+// returns the paths of all resources expired at the given time
+func (db *RedisDB) ExpiredResources(now time.Time) ([][]string, error) {
+	paths, err := db.Client.ZRangeByScore(db.expiryKey(), redis.ZRangeByScore{
+		Min: "-inf",
+		Max: strconv.FormatInt(expiryMillis(now), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
 	}
-	return db.addResource(elts, "", "", strconv.FormatBool(item))
+	expired := [][]string{}
+	for _, path := range paths {
+		expired = append(expired, strings.Split(path, "/"))
+	}
+	return expired, nil
 }
 
 // checks to see if the resource exists
 func (db *RedisDB) ResourceExists(elts []string) (bool, error) {
-	key, _, _, err := mkKeys(elts)
+	key, _, _, err := mkKeys(db.root, elts)
 	if err != nil {
 		return false, err
 	}
@@ -120,9 +393,10 @@ func (db *RedisDB) ResourceExists(elts []string) (bool, error) {
 // if the Resource could not be found returns an error
 func (db *RedisDB) GetResource(elts []string) (Resource, error) {
 	if len(elts) == 0 { // root resource
-		return mkResource(db, []string{}, "root", "root:_children", "root:_hooks", "{}"), nil
+		root := db.root
+		return mkResource(db, []string{}, root, root+":_children", root+":_hooks", "{}"), nil
 	}
-	key, childKey, hookKey, err := mkKeys(elts)
+	key, childKey, hookKey, err := mkKeys(db.root, elts)
 	if err != nil {
 		return nil, err
 	}
@@ -143,28 +417,39 @@ func (db *RedisDB) GetResource(elts []string) (Resource, error) {
 // deletes a resource
 // delete non-leaf resources generates an error
 func (r *RedisResource) Delete() error {
+	return r.DeleteIfVersion(anyVersion)
+}
+
+// deletes a resource if its version matches
+func (r *RedisResource) DeleteIfVersion(version int64) error {
+	_, err := r.deleteIf(version, "")
+	return err
+}
+
+// deletes a resource if it is expired at the given time, returns false if it is not expired
+func (r *RedisResource) DeleteIfExpired(now time.Time) (bool, error) {
+	return r.deleteIf(anyVersion, strconv.FormatInt(expiryMillis(now), 10))
+}
+
+// deletes a leaf resource with the delete script, returns true if the resource has been deleted
+func (r *RedisResource) deleteIf(version int64, expiredAt string) (bool, error) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 	elts, key, childKey, hookKey := r.elts, r.key, r.childKey, r.hookKey
 	if len(elts) == 0 {
-		return errors.New(fmt.Sprintf("Can not delete root resource %s", key))
-	}
-	children, err := r.getChildren()
-	if err != nil {
-		return err
+		return false, errors.New(fmt.Sprintf("Can not delete root resource %s", key))
 	}
-	if len(children) != 0 {
-		return errors.New(fmt.Sprintf("Can not delete non-leaf resource %s", key))
-	}
-	parent, err := r.db.GetResource(elts[:len(elts)-1])
+	parentKey, parentChildKey, err := r.db.resourceKeys(elts[:len(elts)-1])
 	if err != nil {
-		return err
+		return false, err
 	}
-	err = parent.(*RedisResource).removeChildKey(key)
+	keys := []string{key, childKey, hookKey, parentKey, parentChildKey, r.db.expiryKey(), historyKey(key)}
+	args := []string{strconv.FormatInt(version, 10), strings.Join(elts, "/"), expiredAt}
+	deleted, err := r.db.Client.Eval(deleteScript, keys, args).Result()
 	if err != nil {
-		return err
+		return false, scriptError(err)
 	}
-	return r.db.Client.Del(key, childKey, hookKey).Err()
+	return deleted != int64(0), nil
 }
 
 // helper to add child key to the list of children
@@ -206,6 +491,32 @@ func (r *RedisResource) GetValue() (string, []byte, error) {
 	return contentType, []byte(value), nil
 }
 
+// returns the time the resource expires, the zero time if it does not expire
+func (r *RedisResource) GetExpiry() (time.Time, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	expires, err := r.db.Client.HGet(r.key, expiresField).Int64()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return millisExpiry(expires), nil
+}
+
+// sets the time the resource expires, the zero time removes the expiry
+func (r *RedisResource) SetExpiry(expires time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.elts) == 0 {
+		return errors.New("Root resource can not expire")
+	}
+	keys := []string{r.key, r.db.expiryKey()}
+	args := []string{strconv.FormatInt(expiryMillis(expires), 10), strings.Join(r.elts, "/")}
+	return r.db.Client.Eval(setExpiryScript, keys, args).Err()
+}
+
 // returns a list with all children's IDs
 func (r *RedisResource) GetChildren() ([]string, error) {
 	r.lock.Lock()
@@ -222,33 +533,147 @@ func (r *RedisResource) getChildren() ([]string, error) {
 }
 
 func (r *RedisResource) SetValue(contentType string, value []byte) error {
+	_, err := r.SetValueIfVersion(contentType, value, anyVersion, time.Time{})
+	return err
+}
+
+// sets the value if the version matches, returns the new version
+// the expiry is set together with the value, the zero time keeps the current expiry
+func (r *RedisResource) SetValueIfVersion(contentType string, value []byte, version int64, expires time.Time) (int64, error) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	r.db.Client.HSet(r.key, valueField, string(value))
-	r.db.Client.HSet(r.key, contentTypeField, contentType)
-	return nil
+	if len(r.elts) == 0 && !expires.IsZero() {
+		return 0, errors.New("Root resource can not expire")
+	}
+	now := strconv.FormatInt(expiryMillis(time.Now()), 10)
+	args := []string{strconv.FormatInt(version, 10), contentType, string(value), now,
+		strconv.FormatInt(expiryMillis(expires), 10), strings.Join(r.elts, "/")}
+	keys := []string{r.key, historyKey(r.key), r.db.expiryKey()}
+	result, err := r.db.Client.Eval(setValueScript, keys, args).Result()
+	if err != nil {
+		return 0, scriptError(err)
+	}
+	newVersion, ok := result.(int64)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Unexpected version %v", result))
+	}
+	return newVersion, nil
 }
 
-// adds a resource to a collection
-// the resource may not be an item
-func (r *RedisResource) AddToCollection(contentType string, data []byte) (string, error) {
+// returns the key of the list holding the history of a resource, newest revision first
+// every entry consists of version, time, content type and value separated by newlines
+func historyKey(key string) string {
+	return key + ":_history"
+}
+
+// parses an entry of the history list
+func parseRevision(entry string) (*Revision, error) {
+	parts := strings.SplitN(entry, "\n", 4)
+	if len(parts) != 4 {
+		return nil, errors.New("Invalid history entry")
+	}
+	version, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	ms, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &Revision{version, millisExpiry(ms), parts[2], []byte(parts[3])}, nil
+}
+
+// returns the number of revisions kept in the history, 0 if disabled
+func (r *RedisResource) GetHistoryDepth() (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	depth, err := r.db.Client.HGet(r.key, historyDepthField).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return int(depth), err
+}
+
+// sets the number of revisions kept in the history
+// 0 disables the history and removes all revisions
+func (r *RedisResource) SetHistoryDepth(depth int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if depth < 0 {
+		return errors.New(fmt.Sprintf("Invalid history depth %d", depth))
+	}
+	multi := r.db.Client.Multi()
+	defer multi.Close()
+	_, err := multi.Exec(func() error {
+		multi.HSet(r.key, historyDepthField, strconv.Itoa(depth))
+		if depth == 0 {
+			multi.Del(historyKey(r.key))
+		} else {
+			multi.LTrim(historyKey(r.key), 0, int64(depth-1))
+		}
+		return nil
+	})
+	return err
+}
+
+// returns all revisions in the history, newest first
+func (r *RedisResource) GetHistory() ([]*Revision, error) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	item, err := r.db.Client.HGet(r.key, itemField).Result()
+	entries, err := r.db.Client.LRange(historyKey(r.key), 0, -1).Result()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if item != "false" {
-		return "", errors.New("Can not add to item")
+	revisions := []*Revision{}
+	for _, entry := range entries {
+		revision, err := parseRevision(entry)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
 	}
-	nextId, err := r.db.Client.HIncrBy(r.key, nextIDField, 1).Result()
+	return revisions, nil
+}
+
+// returns the revision of the given version from the history
+func (r *RedisResource) GetRevision(version int64) (*Revision, error) {
+	revisions, err := r.GetHistory()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	return findRevision(revisions, version)
+}
+
+// returns the version of the resource
+// the version changes on every change of the value or the children
+func (r *RedisResource) Version() (int64, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	version, err := r.db.Client.HGet(r.key, versionField).Int64()
+	if err == redis.Nil { // resources created before versions were introduced
+		return 0, nil
 	}
-	name := strconv.FormatInt(nextId-1, 10)
-	newElts := append(r.elts, name)
-	r.db.addResource(newElts, string(data), contentType, "true")
+	return version, err
+}
 
+// adds a resource to a collection
+// the resource may not be an item
+// the check, the new ID, the new resource and its expiry are done atomically
+// the new resource expires at the given time, the zero time for never
+func (r *RedisResource) AddToCollection(contentType string, data []byte, expires time.Time) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	keys := []string{r.key, r.childKey, r.db.expiryKey()}
+	args := []string{contentType, string(data), strconv.FormatInt(initialVersion(), 10),
+		strconv.FormatInt(expiryMillis(expires), 10), strings.Join(r.elts, "/")}
+	result, err := r.db.Client.Eval(addScript, keys, args).Result()
+	if err != nil {
+		return "", err
+	}
+	name, ok := result.(string)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Unexpected name %v", result))
+	}
 	return name, nil
 }
 
@@ -334,8 +759,7 @@ func (r *RedisResource) setHook(id string, data []byte) error {
 	if err != nil {
 		return err
 	}
-	r.db.Client.HSet(r.hookKey, hook.Id, string(hookData))
-	return nil
+	return r.db.Client.HSet(r.hookKey, hook.Id, string(hookData)).Err()
 }
 
 func (r *RedisResource) DeleteHook(id string) error {
@@ -417,3 +841,406 @@ func (r *RedisResource) DeleteForward() error {
 	r.forward = "{}"
 	return nil
 }
+
+// returns the keys of the list holding a delivery queue and of the list holding its dead letters
+func (db *RedisDB) queueKeys(queue string) (string, string) {
+	return db.root + "-queue:" + queue, db.root + "-dead:" + queue
+}
+
+// returns the keys of the list holding the delivery log of a queue and of the hash holding its counters
+func (db *RedisDB) logKeys(queue string) (string, string) {
+	return db.root + "-log:" + queue, db.root + "-stats:" + queue
+}
+
+// returns the key of the sorted set of queues, scored by the next attempt of their head
+func (db *RedisDB) dueKey() string {
+	return db.root + "-due"
+}
+
+// returns the key holding the owner of the lease of a queue
+func (db *RedisDB) leaseKey(queue string) string {
+	return db.root + "-lease:" + queue
+}
+
+// a delivery as stored in redis, with its times in unix ms for the scripts
+type redisDelivery struct {
+	*Delivery
+	NextMillis    int64 `json:"nextMs"`
+	CreatedMillis int64 `json:"createdMs"`
+}
+
+// returns a delivery as stored in a queue or in the dead letters
+func marshalDelivery(d *Delivery) ([]byte, error) {
+	return json.Marshal(redisDelivery{d, expiryMillis(d.NextAttempt), expiryMillis(d.Created)})
+}
+
+// defines queueDue(key, fallback), returning the time in unix ms the head of a non empty queue is due, see queueDue in Go
+// deliveries stored without their times in ms are due at the fallback
+const queueDueScript = `
+local function queueDue(key, fallback)
+	local head = cjson.decode(redis.call('LINDEX', key, 0))
+	if not head.nextMs then
+		return fallback
+	end
+	local batch = head.batch or 0
+	if batch > 0 and head.attempts == 0 and redis.call('LLEN', key) >= batch then
+		local last = cjson.decode(redis.call('LINDEX', key, batch - 1))
+		if last.createdMs and last.createdMs < head.nextMs then
+			return last.createdMs
+		end
+	end
+	return head.nextMs
+end
+`
+
+// appends a delivery to a queue and schedules the queue if it was empty or a batch is full
+// KEYS are the queue and the due set
+// ARGV are the delivery, the name of the queue, the next attempt in unix ms,
+// the batch size and the creation of the delivery in unix ms
+const enqueueScript = `
+local n = redis.call('RPUSH', KEYS[1], ARGV[1])
+if n == 1 then
+	redis.call('ZADD', KEYS[2], ARGV[3], ARGV[2])
+elseif tonumber(ARGV[4]) > 0 and n >= tonumber(ARGV[4]) and cjson.decode(redis.call('LINDEX', KEYS[1], 0)).attempts == 0 then
+	redis.call('ZADD', KEYS[2], ARGV[5], ARGV[2])
+end
+return 1
+`
+
+// replaces the head of a queue and schedules the queue for the next attempt
+// KEYS are the queue and the due set
+// ARGV are the ID of the head, the updated delivery, the name of the queue and the next attempt in unix ms
+const retryScript = `
+local head = redis.call('LINDEX', KEYS[1], 0)
+if not head or cjson.decode(head).id ~= ARGV[1] then
+	return redis.error_reply('Delivery not found')
+end
+redis.call('LSET', KEYS[1], 0, ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[4], ARGV[3])
+return 1
+`
+
+// removes the head of a queue, adds it to the dead letters if requested and schedules the queue for its next head
+// KEYS are the queue, the dead letters and the due set
+// ARGV are the ID of the head, the delivery or an empty string if it is not dead,
+// the name of the queue, the time in unix ms and the maximal number of dead letters
+const finishScript = queueDueScript + `
+local head = redis.call('LINDEX', KEYS[1], 0)
+if not head or cjson.decode(head).id ~= ARGV[1] then
+	return redis.error_reply('Delivery not found')
+end
+redis.call('LPOP', KEYS[1])
+if ARGV[2] ~= '' then
+	redis.call('RPUSH', KEYS[2], ARGV[2])
+	redis.call('LTRIM', KEYS[2], -tonumber(ARGV[5]), -1)
+end
+if redis.call('LLEN', KEYS[1]) > 0 then
+	redis.call('ZADD', KEYS[3], queueDue(KEYS[1], ARGV[4]), ARGV[3])
+else
+	redis.call('ZREM', KEYS[3], ARGV[3])
+end
+return 1
+`
+
+// moves a dead letter back to the end of its queue
+// KEYS are the dead letters, the queue and the due set
+// ARGV are the dead letter as stored, the delivery to queue, the name of the queue and the time in unix ms
+const replayScript = `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 0 then
+	return redis.error_reply('Delivery not found')
+end
+if redis.call('RPUSH', KEYS[2], ARGV[2]) == 1 then
+	redis.call('ZADD', KEYS[3], ARGV[4], ARGV[3])
+end
+return 1
+`
+
+// takes the lease of a queue for the owner or extends it if the owner holds it already
+// KEYS are the lease
+// ARGV are the owner and the duration of the lease in ms
+const leaseScript = `
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 1
+end
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`
+
+// drops the lease of a queue or the lock of a resource if it is held by the owner
+// KEYS are the lease or the lock
+// ARGV are the owner
+const releaseScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('DEL', KEYS[1])
+end
+return 1
+`
+
+// maps the errors of the delivery scripts to errDeliveryNotFound
+func deliveryScriptError(err error) error {
+	if err != nil && err.Error() == errDeliveryNotFound.Error() {
+		return errDeliveryNotFound
+	}
+	return err
+}
+
+// parses the deliveries stored in a list
+func parseDeliveries(entries []string) ([]*Delivery, error) {
+	deliveries := []*Delivery{}
+	for _, entry := range entries {
+		var d Delivery
+		err := json.Unmarshal([]byte(entry), &d)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, nil
+}
+
+// appends a delivery to the queue, the ID of the delivery is set
+func (db *RedisDB) EnqueueDelivery(queue string, d *Delivery) error {
+	id, err := db.Client.Incr(db.root + "-deliveryID").Result()
+	if err != nil {
+		return err
+	}
+	d.ID = strconv.FormatInt(id, 10)
+	data, err := marshalDelivery(d)
+	if err != nil {
+		return err
+	}
+	queueKey, _ := db.queueKeys(queue)
+	next := strconv.FormatInt(expiryMillis(d.NextAttempt), 10)
+	created := strconv.FormatInt(expiryMillis(d.Created), 10)
+	args := []string{string(data), queue, next, strconv.Itoa(d.Batch), created}
+	return db.Client.Eval(enqueueScript, []string{queueKey, db.dueKey()}, args).Err()
+}
+
+// returns the queues whose head is due
+func (db *RedisDB) DueQueues(now time.Time) ([]string, error) {
+	return db.Client.ZRangeByScore(db.dueKey(), redis.ZRangeByScore{
+		Min: "-inf",
+		Max: strconv.FormatInt(expiryMillis(now), 10),
+	}).Result()
+}
+
+// takes or extends the lease of a queue for the owner, returns false if another owner holds it
+// the lease expires after ttl unless it is extended or released
+func (db *RedisDB) LeaseQueue(queue, owner string, ttl time.Duration) (bool, error) {
+	args := []string{owner, strconv.FormatInt(int64(ttl/time.Millisecond), 10)}
+	leased, err := db.Client.Eval(leaseScript, []string{db.leaseKey(queue)}, args).Result()
+	if err != nil {
+		return false, err
+	}
+	return leased != int64(0), nil
+}
+
+// releases the lease of a queue if it is held by the owner
+func (db *RedisDB) ReleaseQueue(queue, owner string) error {
+	return db.Client.Eval(releaseScript, []string{db.leaseKey(queue)}, []string{owner}).Err()
+}
+
+// returns the number of deliveries of all queues which are not empty
+func (db *RedisDB) QueueDepths() (map[string]int, error) {
+	queues, err := db.Client.ZRangeByScore(db.dueKey(), redis.ZRangeByScore{Min: "-inf", Max: "+inf"}).Result()
+	if err != nil {
+		return nil, err
+	}
+	depths := map[string]int{}
+	for _, queue := range queues {
+		queueKey, _ := db.queueKeys(queue)
+		depth, err := db.Client.LLen(queueKey).Result()
+		if err != nil {
+			return nil, err
+		}
+		depths[queue] = int(depth)
+	}
+	return depths, nil
+}
+
+// returns the deliveries of a queue, the head first
+func (db *RedisDB) GetDeliveries(queue string) ([]*Delivery, error) {
+	queueKey, _ := db.queueKeys(queue)
+	entries, err := db.Client.LRange(queueKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseDeliveries(entries)
+}
+
+// stores the failed attempt of the head of the queue and schedules the queue for the next attempt
+func (db *RedisDB) RetryDelivery(queue string, d *Delivery) error {
+	data, err := marshalDelivery(d)
+	if err != nil {
+		return err
+	}
+	queueKey, _ := db.queueKeys(queue)
+	next := strconv.FormatInt(expiryMillis(d.NextAttempt), 10)
+	args := []string{d.ID, string(data), queue, next}
+	return deliveryScriptError(db.Client.Eval(retryScript, []string{queueKey, db.dueKey()}, args).Err())
+}
+
+// removes the head of the queue, it is added to the dead letters if dead is set
+func (db *RedisDB) FinishDelivery(queue string, d *Delivery, dead bool) error {
+	deadLetter := ""
+	if dead {
+		data, err := marshalDelivery(d)
+		if err != nil {
+			return err
+		}
+		deadLetter = string(data)
+	}
+	queueKey, deadKey := db.queueKeys(queue)
+	now := strconv.FormatInt(expiryMillis(time.Now()), 10)
+	keys := []string{queueKey, deadKey, db.dueKey()}
+	args := []string{d.ID, deadLetter, queue, now, strconv.Itoa(maxDeadLetters)}
+	return deliveryScriptError(db.Client.Eval(finishScript, keys, args).Err())
+}
+
+// returns the dead letters of a queue, the oldest first
+func (db *RedisDB) GetDeadLetters(queue string) ([]*Delivery, error) {
+	_, deadKey := db.queueKeys(queue)
+	entries, err := db.Client.LRange(deadKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseDeliveries(entries)
+}
+
+// returns a dead letter as stored in the list
+func (db *RedisDB) deadLetterEntry(queue, id string) (string, *Delivery, error) {
+	_, deadKey := db.queueKeys(queue)
+	entries, err := db.Client.LRange(deadKey, 0, -1).Result()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, entry := range entries {
+		var d Delivery
+		if json.Unmarshal([]byte(entry), &d) == nil && d.ID == id {
+			return entry, &d, nil
+		}
+	}
+	return "", nil, errDeliveryNotFound
+}
+
+// moves a dead letter back to the end of the queue, its attempts are reset
+func (db *RedisDB) ReplayDeadLetter(queue, id string) error {
+	entry, d, err := db.deadLetterEntry(queue, id)
+	if err != nil {
+		return err
+	}
+	replayed := replayedDelivery(d)
+	data, err := marshalDelivery(replayed)
+	if err != nil {
+		return err
+	}
+	queueKey, deadKey := db.queueKeys(queue)
+	now := strconv.FormatInt(expiryMillis(replayed.NextAttempt), 10)
+	keys := []string{deadKey, queueKey, db.dueKey()}
+	args := []string{entry, string(data), queue, now}
+	return deliveryScriptError(db.Client.Eval(replayScript, keys, args).Err())
+}
+
+// drops a dead letter
+func (db *RedisDB) DeleteDeadLetter(queue, id string) error {
+	entry, _, err := db.deadLetterEntry(queue, id)
+	if err != nil {
+		return err
+	}
+	_, deadKey := db.queueKeys(queue)
+	removed, err := db.Client.LRem(deadKey, 1, entry).Result()
+	if err == nil && removed == 0 {
+		return errDeliveryNotFound
+	}
+	return err
+}
+
+// drops all pending deliveries, dead letters and the delivery log of a queue
+func (db *RedisDB) DeleteDeliveries(queue string) error {
+	queueKey, deadKey := db.queueKeys(queue)
+	logKey, statsKey := db.logKeys(queue)
+	multi := db.Client.Multi()
+	defer multi.Close()
+	_, err := multi.Exec(func() error {
+		multi.Del(queueKey, deadKey, logKey, statsKey)
+		multi.ZRem(db.dueKey(), queue)
+		return nil
+	})
+	return err
+}
+
+// logs an attempt to deliver an event of the queue and counts it
+func (db *RedisDB) LogDeliveryAttempt(queue string, a *DeliveryAttempt) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	logKey, statsKey := db.logKeys(queue)
+	multi := db.Client.Multi()
+	defer multi.Close()
+	_, err = multi.Exec(func() error {
+		multi.LPush(logKey, string(data))
+		multi.LTrim(logKey, 0, maxDeliveryLog-1)
+		if a.Error == "" {
+			multi.HIncrBy(statsKey, "successes", 1)
+			multi.HSet(statsKey, "consecutiveFailures", "0")
+		} else {
+			multi.HIncrBy(statsKey, "failures", 1)
+			multi.HIncrBy(statsKey, "consecutiveFailures", 1)
+		}
+		return nil
+	})
+	return err
+}
+
+// returns the latest delivery attempts of a queue, the newest first
+func (db *RedisDB) GetDeliveryLog(queue string) ([]*DeliveryAttempt, error) {
+	logKey, _ := db.logKeys(queue)
+	entries, err := db.Client.LRange(logKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	attempts := []*DeliveryAttempt{}
+	for _, entry := range entries {
+		var a DeliveryAttempt
+		err = json.Unmarshal([]byte(entry), &a)
+		if err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, &a)
+	}
+	return attempts, nil
+}
+
+// returns the counters of the delivery attempts of a queue
+func (db *RedisDB) GetDeliveryStats(queue string) (*DeliveryStats, error) {
+	_, statsKey := db.logKeys(queue)
+	counters, err := db.Client.HGetAllMap(statsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	var stats DeliveryStats
+	fields := map[string]*int64{
+		"successes":           &stats.Successes,
+		"failures":            &stats.Failures,
+		"consecutiveFailures": &stats.ConsecutiveFailures,
+	}
+	for field, value := range fields {
+		if v, ok := counters[field]; ok {
+			*value, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &stats, nil
+}
+
+// resets the number of consecutive failures of a queue
+func (db *RedisDB) ResetDeliveryFailures(queue string) error {
+	_, statsKey := db.logKeys(queue)
+	return db.Client.HSet(statsKey, "consecutiveFailures", "0").Err()
+}
@@ -5,13 +5,58 @@ import (
 	"encoding/json"
 	"strings"
 	"testing"
+	"time"
 )
 
+func TestRedisConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T) (GoBusDB, func()) {
+		db := NewRedisDB()
+		teardownRedis(db)
+		return db, func() { teardownRedis(db) }
+	})
+}
+
+func TestRedisQueueLease(t *testing.T) {
+	db := NewRedisDB()
+	db.LeaseQueue("a/_hooks/0", "owner", time.Minute)
+	if leased, err := db.LeaseQueue("a/_hooks/0", "other", time.Minute); err != nil || leased {
+		t.Error("Lease taken twice", leased, err)
+	}
+	db.ReleaseQueue("a/_hooks/0", "other")
+	if leased, _ := db.LeaseQueue("a/_hooks/0", "owner", time.Minute); !leased {
+		t.Error("Lease released by another owner")
+	}
+	db.ReleaseQueue("a/_hooks/0", "owner")
+	if leased, _ := db.LeaseQueue("a/_hooks/0", "other", 10*time.Millisecond); !leased {
+		t.Error("Released lease not taken")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if leased, _ := db.LeaseQueue("a/_hooks/0", "owner", time.Minute); !leased {
+		t.Error("Expired lease not taken")
+	}
+	db.ReleaseQueue("a/_hooks/0", "owner")
+}
+
+func TestRedisPrefix(t *testing.T) {
+	db := NewRedisDBFromConfig(RedisConfig{Prefix: "gobus1"})
+	other := NewRedisDB()
+
+	db.CreateResource([]string{"level0"}, true, "", nil, time.Time{})
+	if exists, _ := other.ResourceExists([]string{"level0"}); exists {
+		t.Error("prefix not used")
+	}
+	root, _ := db.GetResource([]string{})
+	if children, _ := root.GetChildren(); len(children) != 1 || children[0] != "gobus1:root:level0" {
+		t.Error("child key not prefixed", children)
+	}
+	teardownRedis(db)
+}
+
 func TestCreateResourceOneLevelItem(t *testing.T) {
 	db := NewRedisDB()
 
 	elts := []string{"level0"}
-	db.CreateResource(elts, true)
+	db.CreateResource(elts, true, "", nil, time.Time{})
 	res, _ := db.GetResource(elts)
 	if item, _ := res.IsItem(); !item {
 		t.Error("Item not properly set")
@@ -26,7 +71,7 @@ func TestCreateResourceTwoLevelItem(t *testing.T) {
 	db := NewRedisDB()
 
 	elts := []string{"level0", "level1"}
-	res, _ := db.CreateResource(elts, true)
+	res, _ := db.CreateResource(elts, true, "", nil, time.Time{})
 	if item, _ := res.IsItem(); !item {
 		t.Error("Item not properly set")
 	}
@@ -63,7 +108,7 @@ func TestCreateResourceTwoLevelCollection(t *testing.T) {
 	db := NewRedisDB()
 
 	elts := []string{"level0", "level1"}
-	res, _ := db.CreateResource(elts, false)
+	res, _ := db.CreateResource(elts, false, "", nil, time.Time{})
 	if item, _ := res.IsItem(); item {
 		t.Error("Item not properly set")
 	}
@@ -85,7 +130,7 @@ func TestCreateResourceThreeLevelCollection(t *testing.T) {
 	db := NewRedisDB()
 
 	elts := []string{"level0", "level1", "level2"}
-	res, _ := db.CreateResource(elts, false)
+	res, _ := db.CreateResource(elts, false, "", nil, time.Time{})
 	if item, _ := res.IsItem(); item {
 		t.Error("Item not properly set")
 	}
@@ -100,13 +145,13 @@ func TestCreateMultipleResources(t *testing.T) {
 	db := NewRedisDB()
 
 	elts := []string{"level01"}
-	db.CreateResource(elts, false)
+	db.CreateResource(elts, false, "", nil, time.Time{})
 
 	elts = []string{"level02"}
-	db.CreateResource(elts, false)
+	db.CreateResource(elts, false, "", nil, time.Time{})
 
 	elts = []string{"level03"}
-	db.CreateResource(elts, false)
+	db.CreateResource(elts, false, "", nil, time.Time{})
 
 	res, _ := db.GetResource([]string{})
 	if children, _ := res.GetChildren(); len(children) != 3 {
@@ -119,22 +164,22 @@ func TestCreateResourceIllegalName(t *testing.T) {
 	db := NewRedisDB()
 
 	elts := []string{"level01"}
-	db.CreateResource(elts, false)
+	db.CreateResource(elts, false, "", nil, time.Time{})
 
 	elts = []string{"level01", "_hooks"}
-	_, err := db.CreateResource(elts, false)
+	_, err := db.CreateResource(elts, false, "", nil, time.Time{})
 	if err == nil {
 		t.Error("Should not be able to create a resource _hooks")
 	}
 
 	elts = []string{"level01", "_forward"}
-	_, err = db.CreateResource(elts, false)
+	_, err = db.CreateResource(elts, false, "", nil, time.Time{})
 	if err == nil {
 		t.Error("Should not be able to create a resource _forwards")
 	}
 
 	elts = []string{"level01-lock"}
-	_, err = db.CreateResource(elts, false)
+	_, err = db.CreateResource(elts, false, "", nil, time.Time{})
 	if err == nil {
 		t.Error("Should not be able to create a resource including -locks")
 	}
@@ -143,7 +188,7 @@ func TestCreateResourceIllegalName(t *testing.T) {
 func TestGetResource(t *testing.T) {
 	db := NewRedisDB()
 	elts := []string{"level0", "level1", "level2"}
-	db.CreateResource(elts, false)
+	db.CreateResource(elts, false, "", nil, time.Time{})
 
 	res, err := db.GetResource(elts)
 	if err != nil {
@@ -158,7 +203,7 @@ func TestGetResource(t *testing.T) {
 func TestGetInexistingResource(t *testing.T) {
 	db := NewRedisDB()
 	elts := []string{"level0", "level1", "level2"}
-	db.CreateResource(elts, false)
+	db.CreateResource(elts, false, "", nil, time.Time{})
 	elts = []string{"level0", "level1", "level2", "level3", "level4"}
 	_, err := db.GetResource(elts)
 	if err == nil {
@@ -170,7 +215,7 @@ func TestGetInexistingResource(t *testing.T) {
 func TestDeleteResource(t *testing.T) {
 	db := NewRedisDB()
 	elts := []string{"level0", "level1", "level2"}
-	res, _ := db.CreateResource(elts, false)
+	res, _ := db.CreateResource(elts, false, "", nil, time.Time{})
 
 	err := res.Delete()
 	if err != nil {
@@ -193,9 +238,9 @@ func TestDeleteResource(t *testing.T) {
 func TestAddCollection(t *testing.T) {
 	db := NewRedisDB()
 	elts := []string{"level0"}
-	res, _ := db.CreateResource(elts, false)
+	res, _ := db.CreateResource(elts, false, "", nil, time.Time{})
 
-	name, err := res.AddToCollection("text", []byte("bla"))
+	name, err := res.AddToCollection("text", []byte("bla"), time.Time{})
 	if err != nil {
 		t.Error("add to collection error")
 	}
@@ -208,7 +253,7 @@ func TestAddCollection(t *testing.T) {
 		t.Error("wrong data after add")
 	}
 
-	name, _ = res.AddToCollection("text", []byte("1bla"))
+	name, _ = res.AddToCollection("text", []byte("1bla"), time.Time{})
 	if strings.Compare(name, "1") != 0 {
 		t.Error("add index 1 wrong")
 	}
@@ -224,7 +269,7 @@ func TestAddHook(t *testing.T) {
 	db := NewRedisDB()
 	hookData := []byte(`{"name": "hook_name", "url": "http://www.test.ch/my/resource"}`)
 	resPath := []string{"path"}
-	res, _ := db.CreateResource(resPath, true)
+	res, _ := db.CreateResource(resPath, true, "", nil, time.Time{})
 	name, err := res.AddHook(hookData)
 	if err != nil {
 		t.Error("Hook Add failed", err)
@@ -239,7 +284,7 @@ func TestGetHook(t *testing.T) {
 	db := NewRedisDB()
 	hookData := []byte(`{"name": "hook_name", "url": "http://www.test.ch/my/resource"}`)
 	resPath := []string{"path"}
-	res, _ := db.CreateResource(resPath, true)
+	res, _ := db.CreateResource(resPath, true, "", nil, time.Time{})
 	name, _ := res.AddHook(hookData)
 	newHook, err := res.GetHook(name)
 	newHookData, err := json.Marshal(newHook)
@@ -256,7 +301,7 @@ func TestDeleteHook(t *testing.T) {
 	db := NewRedisDB()
 	hookData := []byte(`{"name": "hook_name", "url": "http://www.test.ch/my/resource"}`)
 	resPath := []string{"path"}
-	res, _ := db.CreateResource(resPath, true)
+	res, _ := db.CreateResource(resPath, true, "", nil, time.Time{})
 	name, _ := res.AddHook(hookData)
 	err := res.DeleteHook(name)
 	if err != nil {
@@ -1,20 +1,88 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
 type GoBusDB interface {
-	CreateResource(elts []string, item bool) (Resource, error)
+	CreateResource(elts []string, item bool, contentType string, value []byte, expires time.Time) (Resource, error)
 	GetResource(elts []string) (Resource, error)
 	ResourceExists(elts []string) (bool, error)
+	ExpiredResources(now time.Time) ([][]string, error)
+
+	// delivery queues of the hooks, see hookQueue
+	// deliveries are taken from the head of a queue, failed ones end up in its dead letters
+	EnqueueDelivery(queue string, d *Delivery) error
+	DueQueues(now time.Time) ([]string, error)
+	LeaseQueue(queue, owner string, ttl time.Duration) (bool, error)
+	ReleaseQueue(queue, owner string) error
+	QueueDepths() (map[string]int, error)
+	GetDeliveries(queue string) ([]*Delivery, error)
+	RetryDelivery(queue string, d *Delivery) error
+	FinishDelivery(queue string, d *Delivery, dead bool) error
+	GetDeadLetters(queue string) ([]*Delivery, error)
+	ReplayDeadLetter(queue, id string) error
+	DeleteDeadLetter(queue, id string) error
+	DeleteDeliveries(queue string) error
+	LogDeliveryAttempt(queue string, a *DeliveryAttempt) error
+	GetDeliveryLog(queue string) ([]*DeliveryAttempt, error)
+	GetDeliveryStats(queue string) (*DeliveryStats, error)
+	ResetDeliveryFailures(queue string) error
+}
+
+// returns the unix time in milliseconds as stored by the backends, 0 for the zero time
+func expiryMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
 }
 
+// converts milliseconds stored by the backends back to a time
+func millisExpiry(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// version to pass to conditional operations to skip the version check
+const anyVersion int64 = -1
+
+// returns the version of a new resource
+// versions start at the creation time in microseconds instead of 0, so a resource recreated
+// at the same path does not repeat the versions and entity tags of the deleted one
+func initialVersion() int64 {
+	return time.Now().UnixNano() / int64(time.Microsecond)
+}
+
+// returned by conditional operations if the version does not match
+var errVersionMismatch = errors.New("Version does not match")
+
+// returned by CreateResource if the resource exists already
+var errResourceExists = errors.New("Resource exists already")
+
 type Resource interface {
 	Name() (string, error)
 	Delete() error
+	DeleteIfVersion(version int64) error
+	DeleteIfExpired(now time.Time) (bool, error)
 	IsItem() (bool, error)
 	GetElts() []string
+	Version() (int64, error)
 	GetValue() (string, []byte, error)
 	SetValue(contentType string, value []byte) error
+	SetValueIfVersion(contentType string, value []byte, version int64, expires time.Time) (int64, error)
+	GetHistoryDepth() (int, error)
+	SetHistoryDepth(depth int) error
+	GetHistory() ([]*Revision, error)
+	GetRevision(version int64) (*Revision, error)
 	GetChildren() ([]string, error)
-	AddToCollection(contentType string, data []byte) (string, error)
+	GetExpiry() (time.Time, error)
+	SetExpiry(expires time.Time) error
+	AddToCollection(contentType string, data []byte, expires time.Time) (string, error)
 	SetHook(id string, data []byte) error
 	AddHook(data []byte) (string, error)
 	DeleteHook(id string) error
@@ -25,3 +93,28 @@ type Resource interface {
 	GetForward() (*Forward, error)
 	AddForward(data []byte) error
 }
+
+// configuration of the database backend
+type DBConfig struct {
+	Backend string // redis, memory or bolt, empty selects redis
+	Path    string // database file of the bolt backend
+	Redis   RedisConfig
+}
+
+// creates the GoBusDB selected by the configuration
+func NewDB(cfg DBConfig) (GoBusDB, error) {
+	switch cfg.Backend {
+	case "", "redis":
+		return NewRedisDBFromConfig(cfg.Redis), nil
+	case "memory":
+		return NewMemoryDB(), nil
+	case "bolt":
+		path := cfg.Path
+		if path == "" {
+			path = "gobus.db"
+		}
+		return NewBoltDB(path)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown backend %s", cfg.Backend))
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// header to set the time-to-live of an item in seconds on PUT and POST
+// GET returns the remaining time-to-live in the same header
+const ttlHeader = "X-TTL"
+
+type TTL struct {
+	TTL int64 `json:"ttl"` // seconds, 0 if the resource does not expire
+}
+
+// parses a time-to-live in seconds, it has to be positive
+func parseTTL(value string) (time.Duration, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds <= 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid TTL %s", value))
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// returns the expiry for the time-to-live requested in the header, the zero time if not set
+func requestExpiry(hd *HandlerData) (time.Time, error) {
+	value := hd.R.Header.Get(ttlHeader)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	ttl, err := parseTTL(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().Add(ttl), nil
+}
+
+// returns the remaining time-to-live in seconds, rounded up
+// returns 0 if there is no expiry
+func remainingTTL(expires time.Time) int64 {
+	if expires.IsZero() {
+		return 0
+	}
+	remaining := expires.Sub(time.Now())
+	if remaining <= 0 {
+		return 0
+	}
+	return int64((remaining + time.Second - 1) / time.Second)
+}
+
+// sets the expiry of the resource to ttl from now, nothing is done for 0
+func applyTTL(res Resource, ttl time.Duration) error {
+	if ttl == 0 {
+		return nil
+	}
+	return res.SetExpiry(time.Now().Add(ttl))
+}
+
+// deletes the resource if it is expired, the DELETE hooks are called
+// returns true if the resource has been expired, also if it has been removed in the meantime
+// the expiry is checked again when deleting, so a concurrently renewed or cleared TTL is kept
+func expireIfDue(db GoBusDB, res Resource, basePath string) (bool, error) {
+	expires, err := res.GetExpiry()
+	if err != nil {
+		return removed(db, res, err)
+	}
+	now := time.Now()
+	if expires.IsZero() || expires.After(now) {
+		return false, nil
+	}
+	call, err := newHookCall(db, res, "DELETE", basePath)
+	if err != nil {
+		return removed(db, res, err)
+	}
+	deleted, err := res.DeleteIfExpired(now)
+	if err != nil {
+		return removed(db, res, err)
+	}
+	if deleted {
+		call.sendDeleted(db, res.GetElts())
+	}
+	return deleted, nil
+}
+
+// returns true if the resource has been removed in the meantime (e.g. expired by someone else), otherwise err
+func removed(db GoBusDB, res Resource, err error) (bool, error) {
+	if exists, existsErr := db.ResourceExists(res.GetElts()); existsErr == nil && !exists {
+		return true, nil
+	}
+	return false, err
+}
+
+// deletes all expired resources
+func expireResources(db GoBusDB, basePath string) {
+	expired, err := db.ExpiredResources(time.Now())
+	if err != nil {
+		log.Printf("Internal error, could not get expired resources: %v", err.Error())
+		return
+	}
+	for _, elts := range expired {
+		res, err := db.GetResource(elts)
+		if err != nil { // deleted in the meantime
+			continue
+		}
+		_, err = expireIfDue(db, res, basePath)
+		if err != nil {
+			log.Printf("Internal error, could not expire %v: %v", elts, err.Error())
+		}
+	}
+}
+
+// deletes expired resources periodically, does not return
+func runExpiry(db GoBusDB, basePath string, interval time.Duration) {
+	for range time.Tick(interval) {
+		expireResources(db, basePath)
+	}
+}
+
+// ttl handlers
+// returns the remaining time-to-live
+func getTTL(hd *HandlerData, res Resource, cmds []string) {
+	if len(cmds) != 1 {
+		respond(hd, http.StatusNotFound, "Not Found")
+		return
+	}
+	expires, err := res.GetExpiry()
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get TTL")
+		return
+	}
+	data, err := json.Marshal(TTL{remainingTTL(expires)})
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get TTL Json")
+		return
+	}
+	hd.W.Write(data)
+}
+
+// sets the time-to-live of an item
+func putTTL(hd *HandlerData, res Resource, cmds []string) {
+	if len(cmds) != 1 {
+		respond(hd, http.StatusNotFound, "Not Found")
+		return
+	}
+	body := hd.R.Body
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		respond(hd, http.StatusBadRequest, "Invalid Request")
+		return
+	}
+	var ttl TTL
+	err = json.Unmarshal(data, &ttl)
+	if err != nil || ttl.TTL <= 0 {
+		respond(hd, http.StatusBadRequest, "Invalid TTL")
+		return
+	}
+	err = applyTTL(res, time.Duration(ttl.TTL)*time.Second)
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not set TTL")
+		return
+	}
+	respond(hd, http.StatusOK, "TTL set.")
+}
+
+// removes the time-to-live, the item does not expire anymore
+func deleteTTL(hd *HandlerData, res Resource, cmds []string) {
+	if len(cmds) != 1 {
+		respond(hd, http.StatusNotFound, "Not Found")
+		return
+	}
+	err := res.SetExpiry(time.Time{})
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not delete TTL")
+		return
+	}
+	respond(hd, http.StatusOK, "TTL deleted.")
+}
+
+// handles requests for the _ttl command, only items can expire
+func handleTTLRequest(hd *HandlerData, res Resource, cmds []string) {
+	isitem, err := res.IsItem()
+	if err != nil {
+		respond(hd, http.StatusInternalServerError, "Could not get Resource type.")
+		return
+	}
+	if !isitem {
+		respond(hd, http.StatusMethodNotAllowed, "Only items can expire.")
+		return
+	}
+	switch hd.R.Method {
+	case "DELETE":
+		deleteTTL(hd, res, cmds)
+	case "GET":
+		getTTL(hd, res, cmds)
+	case "PUT":
+		putTTL(hd, res, cmds)
+	default:
+		respond(hd, http.StatusMethodNotAllowed, "Method not allowed for ttl.")
+	}
+}
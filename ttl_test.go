@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTTL(t *testing.T) {
+	if ttl, err := parseTTL("30"); err != nil || ttl != 30*time.Second {
+		t.Error("TTL not parsed", ttl, err)
+	}
+	for _, value := range []string{"0", "-1", "a", "1.5"} {
+		if _, err := parseTTL(value); err == nil {
+			t.Error("Invalid TTL accepted", value)
+		}
+	}
+}
+
+func TestHandleTTLHeader(t *testing.T) {
+	db := newTestDB()
+	db.CreateResource([]string{"coll"}, false, "", nil, time.Time{})
+
+	// put creates an expiring item
+	hd := createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/coll/item", strings.NewReader("data"))
+	hd.R.Header.Set(ttlHeader, "60")
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusCreated, "Put TTL: 201 not working")
+
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/coll/item", nil)
+	handleRequest(hd)
+	if hd.W.Header().Get(ttlHeader) != "60" {
+		t.Error("Get: TTL not returned", hd.W.Header().Get(ttlHeader))
+	}
+
+	// post creates an expiring item
+	hd = createHandlerData(t, db, "POST", "http://localhost:8080/asdf/qwer/coll", strings.NewReader("data"))
+	hd.R.Header.Set(ttlHeader, "10")
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusCreated, "Post TTL: 201 not working")
+	child, _ := db.GetResource([]string{"coll", "0"})
+	if expires, _ := child.GetExpiry(); expires.IsZero() {
+		t.Error("Post: TTL not set")
+	}
+
+	// invalid ttl
+	hd = createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/coll/item", strings.NewReader("data"))
+	hd.R.Header.Set(ttlHeader, "never")
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusBadRequest, "Put TTL: 400 not working")
+
+	// collections can not expire
+	hd = createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/coll/sub", strings.NewReader(""))
+	hd.R.Header.Set(ttlHeader, "60")
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusBadRequest, "Put TTL on new collection: 400 not working")
+	if exists, _ := db.ResourceExists([]string{"coll", "sub"}); exists {
+		t.Error("Put TTL: collection created")
+	}
+	teardownDB(db)
+}
+
+func TestHandleTTLCommand(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"item"}, true, "", nil, time.Time{})
+	db.CreateResource([]string{"coll"}, false, "", nil, time.Time{})
+
+	hd := createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/item/_ttl", strings.NewReader(`{"ttl": 30}`))
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Put _ttl: 200 not working")
+
+	hd = createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/item/_ttl", nil)
+	handleRequest(hd)
+	if !strings.Contains(hd.W.(*httptest.ResponseRecorder).Body.String(), `{"ttl":30}`) {
+		t.Error("Get _ttl: content not working", hd.W.(*httptest.ResponseRecorder).Body.String())
+	}
+
+	hd = createHandlerData(t, db, "DELETE", "http://localhost:8080/asdf/qwer/item/_ttl", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusOK, "Delete _ttl: 200 not working")
+	if expires, _ := res.GetExpiry(); !expires.IsZero() {
+		t.Error("Delete _ttl: TTL not removed")
+	}
+
+	hd = createHandlerData(t, db, "PUT", "http://localhost:8080/asdf/qwer/coll/_ttl", strings.NewReader(`{"ttl": 30}`))
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusMethodNotAllowed, "Put _ttl on collection: 405 not working")
+	teardownDB(db)
+}
+
+func TestExpireResources(t *testing.T) {
+	db := newTestDB()
+	res, _ := db.CreateResource([]string{"coll", "item"}, true, "", nil, time.Time{})
+	res.SetExpiry(time.Now().Add(-time.Second))
+	stop := startTestDispatcher(db)
+	defer stop()
+
+	// start server for hook test
+	c := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c <- r.Method
+	}))
+	defer ts.Close()
+	res.AddHook([]byte(`{"name": "hook_name", "url": "` + ts.URL + `"}`))
+
+	expireResources(db, "/asdf/qwer")
+	if exists, _ := db.ResourceExists([]string{"coll", "item"}); exists {
+		t.Error("Expired item not deleted")
+	}
+	coll, _ := db.GetResource([]string{"coll"})
+	if children, _ := coll.GetChildren(); len(children) != 0 {
+		t.Error("Expired item still a child", children)
+	}
+	select {
+	case <-c:
+	case <-time.After(time.Second):
+		t.Error("Delete hook not called")
+	}
+
+	// expired items are gone even before they are removed
+	res, _ = db.CreateResource([]string{"coll", "other"}, true, "", nil, time.Time{})
+	res.SetExpiry(time.Now().Add(-time.Second))
+	hd := createHandlerData(t, db, "GET", "http://localhost:8080/asdf/qwer/coll/other", nil)
+	handleRequest(hd)
+	checkCode(t, hd, http.StatusNotFound, "Get expired: 404 not working")
+
+	// losing the race against another expiry is no error
+	res, _ = db.CreateResource([]string{"coll", "raced"}, true, "", nil, time.Time{})
+	res.SetExpiry(time.Now().Add(-time.Second))
+	stale, _ := db.GetResource([]string{"coll", "raced"})
+	res.Delete()
+	if expired, err := expireIfDue(db, stale, "/asdf/qwer"); !expired || err != nil {
+		t.Error("Resource removed in the meantime not treated as expired", expired, err)
+	}
+	teardownDB(db)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// a message sent by a websocket client
+// type is one of subscribe, unsubscribe and request
+type WSRequest struct {
+	ID      string            `json:"id"`
+	Type    string            `json:"type"`
+	Method  string            `json:"method,omitempty"`
+	Path    string            `json:"path"` // relative to the base URL, may contain a query
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// a message sent to a websocket client
+// type is response for an answer to a request, event for a notification
+// and unsubscribed if a subscription has been ended by the server
+type WSMessage struct {
+	ID      string            `json:"id,omitempty"`
+	Type    string            `json:"type"`
+	Status  int               `json:"status,omitempty"`
+	Path    string            `json:"path,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Event   *HookEvent        `json:"event,omitempty"`
+}
+
+var upgrader = websocket.Upgrader{}
+
+const (
+	wsMaxMessageSize = 1 << 20          // larger messages close the connection
+	wsPongWait       = 60 * time.Second // a client not answering pings for this long is disconnected
+	wsPingInterval   = wsPongWait * 9 / 10
+	wsWriteWait      = 10 * time.Second
+)
+
+// a websocket connection with its subscriptions
+type wsConnection struct {
+	hd            *HandlerData
+	conn          *websocket.Conn
+	writeMutex    sync.Mutex
+	mutex         sync.Mutex
+	subscriptions map[string]*subscription // by URL path of the resource
+	done          chan bool                // closed when the connection ends
+}
+
+// collects the response of a request dispatched over a websocket
+type wsResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *wsResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *wsResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+func (w *wsResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// sends a message, safe for concurrent use
+func (c *wsConnection) send(msg *WSMessage) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteJSON(msg)
+}
+
+// pings the client until the connection ends, the pongs extend the read deadline
+func (c *wsConnection) ping() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)) != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// sends a response without headers and body
+func (c *wsConnection) respond(req *WSRequest, status int, msg string) error {
+	return c.send(&WSMessage{ID: req.ID, Type: "response", Status: status, Path: req.Path, Body: msg})
+}
+
+// returns the URL path of a path given by the client
+func (c *wsConnection) urlPath(relPath string) string {
+	return path.Join(c.hd.BaseURL.Path, relPath)
+}
+
+// dispatches a request through the same logic as http requests
+func (c *wsConnection) request(req *WSRequest) error {
+	u, err := url.Parse(req.Path)
+	if err != nil {
+		return c.respond(req, http.StatusBadRequest, "Invalid path")
+	}
+	u.Path = c.urlPath(u.Path)
+	r, err := http.NewRequest(strings.ToUpper(req.Method), u.String(), strings.NewReader(req.Body))
+	if err != nil {
+		return c.respond(req, http.StatusBadRequest, "Invalid request")
+	}
+	r = r.WithContext(c.hd.R.Context())
+	r.Host = c.hd.R.Host
+	for _, name := range []string{"X-Forwarded-Proto", "X-Forwarded-Host"} {
+		r.Header.Set(name, c.hd.R.Header.Get(name))
+	}
+	for name, value := range req.Headers {
+		r.Header.Set(name, value)
+	}
+	w := &wsResponseWriter{header: http.Header{}}
+	hd := &HandlerData{
+		DB:             c.hd.DB,
+		BaseURL:        c.hd.BaseURL,
+		TrustForwarded: c.hd.TrustForwarded,
+		W:              w,
+		R:              r,
+	}
+	_, cmds, err := disectPath(hd.BaseURL.Path, r.URL.Path)
+	if err == nil && len(cmds) > 0 && (cmds[0] == "_ws" || cmds[0] == "_events") {
+		return c.respond(req, http.StatusBadRequest, "Streams can not be opened over a websocket")
+	}
+	if r.URL.Query().Get("wait") != "" { // would block all other messages of the connection
+		return c.respond(req, http.StatusBadRequest, "Long polling is not possible over a websocket, subscribe instead")
+	}
+	handleRequest(hd)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	headers := map[string]string{}
+	for name := range w.header {
+		headers[name] = w.header.Get(name)
+	}
+	return c.send(&WSMessage{
+		ID:      req.ID,
+		Type:    "response",
+		Status:  w.status,
+		Path:    req.Path,
+		Headers: headers,
+		Body:    w.body.String(),
+	})
+}
+
+// forwards the events of a subscription to the client
+func (c *wsConnection) forward(key, relPath string, sub *subscription) {
+	for e := range sub.events {
+		event := e.Event
+		if c.send(&WSMessage{Type: "event", Path: relPath, Event: &event}) != nil {
+			break
+		}
+	}
+	c.mutex.Lock()
+	ended := c.subscriptions[key] == sub
+	if ended {
+		delete(c.subscriptions, key)
+	}
+	c.mutex.Unlock()
+	if ended { // ended by the broker, not by the client
+		c.send(&WSMessage{Type: "unsubscribed", Path: relPath})
+	}
+}
+
+// subscribes to the events of a resource
+func (c *wsConnection) subscribe(req *WSRequest) error {
+	key := c.urlPath(req.Path)
+	c.mutex.Lock()
+	if _, ok := c.subscriptions[key]; ok {
+		c.mutex.Unlock()
+		return c.respond(req, http.StatusOK, "Already subscribed")
+	}
+	sub, _ := broker.subscribe(key, false, -1)
+	c.subscriptions[key] = sub
+	c.mutex.Unlock()
+	go c.forward(key, req.Path, sub)
+	return c.respond(req, http.StatusOK, "Subscribed")
+}
+
+// ends a subscription
+func (c *wsConnection) unsubscribe(req *WSRequest) error {
+	key := c.urlPath(req.Path)
+	c.mutex.Lock()
+	sub, ok := c.subscriptions[key]
+	delete(c.subscriptions, key)
+	c.mutex.Unlock()
+	if !ok {
+		return c.respond(req, http.StatusNotFound, "Not subscribed")
+	}
+	broker.unsubscribe(sub)
+	return c.respond(req, http.StatusOK, "Unsubscribed")
+}
+
+// ends all subscriptions of the connection
+func (c *wsConnection) close() {
+	c.mutex.Lock()
+	subscriptions := c.subscriptions
+	c.subscriptions = map[string]*subscription{}
+	c.mutex.Unlock()
+	for _, sub := range subscriptions {
+		broker.unsubscribe(sub)
+	}
+	close(c.done)
+	c.conn.Close()
+}
+
+// upgrades the request to a websocket and serves the messages of the client
+func handleWebSocket(hd *HandlerData) {
+	conn, err := upgrader.Upgrade(hd.W, hd.R, nil)
+	if err != nil { // the upgrader has responded already
+		return
+	}
+	c := &wsConnection{
+		hd:            hd,
+		conn:          conn,
+		subscriptions: map[string]*subscription{},
+		done:          make(chan bool),
+	}
+	defer c.close()
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	go c.ping()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil { // closed by the client
+			return
+		}
+		var req WSRequest
+		if json.Unmarshal(data, &req) != nil {
+			err = c.send(&WSMessage{Type: "response", Status: http.StatusBadRequest, Body: "Invalid message"})
+			if err != nil {
+				return
+			}
+			continue
+		}
+		switch req.Type {
+		case "request":
+			err = c.request(&req)
+		case "subscribe":
+			err = c.subscribe(&req)
+		case "unsubscribe":
+			err = c.unsubscribe(&req)
+		default:
+			err = c.respond(&req, http.StatusBadRequest, "Unknown message type")
+		}
+		if err != nil {
+			log.Printf("Websocket closed: %v", err.Error())
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// reads the next message of the websocket, fails after a timeout
+func readWSMessage(t *testing.T, conn *websocket.Conn) *WSMessage {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal("Could not read message", err)
+	}
+	return &msg
+}
+
+func TestHandleWebSocket(t *testing.T) {
+	db := newTestDB()
+	db.CreateResource([]string{"ws"}, false, "", nil, time.Time{})
+	baseURL, _ := url.Parse("http://localhost:8080/asdf/qwer/")
+	server := httptest.NewServer(getHandler(db, baseURL, false))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/asdf/qwer/_ws"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal("Could not connect websocket", err)
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(WSRequest{ID: "1", Type: "subscribe", Path: "ws/item"})
+	if msg := readWSMessage(t, conn); msg.ID != "1" || msg.Status != http.StatusOK {
+		t.Error("Subscribe failed", msg)
+	}
+
+	conn.WriteJSON(WSRequest{ID: "2", Type: "request", Method: "PUT", Path: "ws/item", Body: "bla",
+		Headers: map[string]string{"Content-Type": "text/plain"}})
+	// the creation is announced as well
+	for i := 0; i < 2; i++ {
+		msg := readWSMessage(t, conn)
+		switch msg.Type {
+		case "event":
+			if msg.Event.Method != "CREATE" || msg.Event.ModifiedResource != "/asdf/qwer/ws/item" {
+				t.Error("Wrong create event", msg, msg.Event)
+			}
+		case "response":
+			if msg.ID != "2" || msg.Status != http.StatusCreated {
+				t.Error("Put failed", msg)
+			}
+		default:
+			t.Error("Unexpected message", msg)
+		}
+	}
+
+	conn.WriteJSON(WSRequest{ID: "3", Type: "request", Method: "PUT", Path: "ws/item", Body: "blup",
+		Headers: map[string]string{"Content-Type": "text/plain"}})
+	// the event and the response can arrive in any order
+	for i := 0; i < 2; i++ {
+		msg := readWSMessage(t, conn)
+		switch msg.Type {
+		case "event":
+			if msg.Path != "ws/item" || msg.Event.Method != "PUT" || msg.Event.ModifiedResource != "/asdf/qwer/ws/item" {
+				t.Error("Wrong event", msg, msg.Event)
+			}
+		case "response":
+			if msg.ID != "3" || msg.Status != http.StatusOK || msg.Headers["Etag"] == "" {
+				t.Error("Put failed", msg)
+			}
+		default:
+			t.Error("Unexpected message", msg)
+		}
+	}
+
+	conn.WriteJSON(WSRequest{ID: "4", Type: "request", Method: "GET", Path: "ws/item"})
+	msg := readWSMessage(t, conn)
+	if msg.Status != http.StatusOK || msg.Body != "blup" || msg.Headers["Content-Type"] != "text/plain" {
+		t.Error("Get failed", msg)
+	}
+
+	conn.WriteJSON(WSRequest{ID: "5", Type: "unsubscribe", Path: "/ws/item"})
+	if msg := readWSMessage(t, conn); msg.ID != "5" || msg.Status != http.StatusOK {
+		t.Error("Unsubscribe failed", msg)
+	}
+	conn.WriteJSON(WSRequest{ID: "6", Type: "unsubscribe", Path: "ws/item"})
+	if msg := readWSMessage(t, conn); msg.Status != http.StatusNotFound {
+		t.Error("Unsubscribe twice not refused", msg)
+	}
+
+	conn.WriteJSON(WSRequest{ID: "7", Type: "request", Method: "GET", Path: "ws/item/_events"})
+	if msg := readWSMessage(t, conn); msg.Status != http.StatusBadRequest {
+		t.Error("Stream opened over websocket", msg)
+	}
+
+	conn.WriteJSON(WSRequest{ID: "8", Type: "request", Method: "GET", Path: "ws/item?wait=60"})
+	if msg := readWSMessage(t, conn); msg.ID != "8" || msg.Status != http.StatusBadRequest {
+		t.Error("Long poll accepted over websocket", msg)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("no json"))
+	if msg := readWSMessage(t, conn); msg.Status != http.StatusBadRequest {
+		t.Error("Invalid message accepted", msg)
+	}
+	teardownDB(db)
+}
+
+func TestWebSocketReadLimit(t *testing.T) {
+	db := newTestDB()
+	baseURL, _ := url.Parse("http://localhost:8080/asdf/qwer/")
+	server := httptest.NewServer(getHandler(db, baseURL, false))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/asdf/qwer/_ws"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal("Could not connect websocket", err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, make([]byte, wsMaxMessageSize+1))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Error("Too large message not refused", err)
+	}
+	teardownDB(db)
+}